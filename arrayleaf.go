@@ -0,0 +1,189 @@
+package bitset
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+type (
+	// arrayleaf is a leaf holding the sorted offsets of its set bits, for
+	// leaves with few bits set (see pack)
+	arrayleaf struct {
+		owner   *owner   // owner of the node (see level.owns)
+		offsets []uint16 // offsets of the bits that are set, in order
+	}
+)
+
+// arrayMax returns the most offsets an arrayleaf holds, before it's larger
+// than the bitmap leaf (2 bytes an offset, against a bit per index)
+func arrayMax(l *level) int {
+	return l.total / 16
+}
+
+func newArrayLeaf(l *level) *arrayleaf {
+	return &arrayleaf{owner: l.token()}
+}
+
+// search returns the position of the first offset at or after idx
+func (n *arrayleaf) search(idx uint64) int {
+
+	return sort.Search(len(n.offsets), func(i int) bool {
+		return uint64(n.offsets[i]) >= idx
+	})
+}
+
+func (n *arrayleaf) test(l *level, idx uint64) bool {
+
+	i := n.search(idx)
+	return i < len(n.offsets) && uint64(n.offsets[i]) == idx
+}
+
+func (n *arrayleaf) set(l *level, idx uint64) (set bool, replace node) {
+
+	i := n.search(idx)
+
+	// check if bit already set
+	if i < len(n.offsets) && uint64(n.offsets[i]) == idx {
+		return false, n
+	}
+
+	// too many offsets -> switch to a bitmap leaf
+	if len(n.offsets) >= arrayMax(l) {
+		return unpack(l, n).set(l, idx)
+	}
+
+	n = n.own(l) // copy-on-write, if shared
+
+	n.offsets = append(n.offsets, 0)
+	copy(n.offsets[i+1:], n.offsets[i:])
+	n.offsets[i] = uint16(idx)
+
+	return true, n
+}
+
+func (n *arrayleaf) clr(l *level, idx uint64) (cleared bool, replace node) {
+
+	i := n.search(idx)
+
+	// check if bit already clear
+	if i == len(n.offsets) || uint64(n.offsets[i]) != idx {
+		return false, n
+	}
+
+	if len(n.offsets) == 1 {
+		return true, sparsify(l, n, false)
+	}
+
+	n = n.own(l) // copy-on-write, if shared
+
+	n.offsets = append(n.offsets[:i], n.offsets[i+1:]...)
+
+	return true, n
+}
+
+// range ops are done on a bitmap leaf, which is then packed again
+
+func (n *arrayleaf) setrange(l *level, start, end uint64) (changed uint64, replace node) {
+
+	changed, replace = unpack(l, n).setrange(l, start, end)
+	return changed, repack(l, replace)
+}
+
+func (n *arrayleaf) clrrange(l *level, start, end uint64) (changed uint64, replace node) {
+
+	changed, replace = unpack(l, n).clrrange(l, start, end)
+	return changed, repack(l, replace)
+}
+
+func (n *arrayleaf) fliprange(l *level, start, end uint64) (set, cleared uint64, replace node) {
+
+	set, cleared, replace = unpack(l, n).fliprange(l, start, end)
+	return set, cleared, repack(l, replace)
+}
+
+func (n *arrayleaf) count(l *level) (set uint64) {
+	return uint64(len(n.offsets))
+}
+
+func (n *arrayleaf) countrange(l *level, start, end uint64) (set uint64) {
+	return uint64(n.search(end+1) - n.search(start))
+}
+
+func (n *arrayleaf) nthset(l *level, nth uint64) (idx uint64) {
+	return uint64(n.offsets[nth])
+}
+
+func (n *arrayleaf) nextset(l *level, start, end uint64) (idx uint64, found bool) {
+
+	if i := n.search(start); i < len(n.offsets) && uint64(n.offsets[i]) <= end {
+		return uint64(n.offsets[i]), true
+	}
+
+	return math.MaxUint64, false
+}
+
+func (n *arrayleaf) prevset(l *level, start uint64) (idx uint64, found bool) {
+
+	if start > l.max {
+		start = l.max
+	}
+
+	if i := n.search(start+1) - 1; i >= 0 {
+		return uint64(n.offsets[i]), true
+	}
+
+	return 0, false
+}
+
+func (n *arrayleaf) nextclr(l *level, start, end uint64) (idx uint64, found bool) {
+
+	// skip over the offsets that follow on from start
+	for i := n.search(start); i < len(n.offsets) && uint64(n.offsets[i]) == start; i++ {
+		start++
+	}
+
+	if start <= end {
+		return start, true
+	}
+
+	return math.MaxUint64, false
+}
+
+func (n *arrayleaf) prevclr(l *level, start uint64) (idx uint64, found bool) {
+
+	if start > l.max {
+		start = l.max
+	}
+
+	// skip over the offsets that lead up to start
+	for i := n.search(start); i >= 0 && i < len(n.offsets) && uint64(n.offsets[i]) == start; i-- {
+
+		if start == 0 {
+			return 0, false
+		}
+
+		start--
+	}
+
+	return start, true
+}
+
+// own returns the leaf itself if it's owned by the tree of level l (see
+// level.owns); otherwise the leaf is shared with a clone, and a copy of it is
+// returned to be modified
+func (n *arrayleaf) own(l *level) *arrayleaf {
+
+	if l.owns(n.owner) {
+		return n
+	}
+
+	return &arrayleaf{
+		owner:   l.token(),
+		offsets: append([]uint16(nil), n.offsets...),
+	}
+}
+
+func (n *arrayleaf) String() string {
+	return fmt.Sprintf("arrayleaf(%p): owner=%p offsets=%v", n, n.owner, n.offsets)
+}
@@ -0,0 +1,189 @@
+package bitset
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// NewAtomic returns a new bitset, like NewConcurrent, where Set/Clear/Test of
+// bits in already materialized leaves are lock-free: the bit is flipped with
+// a CAS on its word, and the leaf's numSet is updated atomically. Only the
+// changes to the structure of the tree (materializing a sparse node, or
+// sparsifying a leaf that becomes all-set/all-clr) take the stripe's lock.
+//
+// Since the leaf words may be modified while only holding the stripe's read
+// lock, all other operations (the scans, in particular) take the stripe's
+// exclusive lock.
+//
+// Only bitmap leaves are updated lock-free: with leaves of 2^8 to 2^16 bits,
+// whose sparse leaves are array/run leaves (see pack), Set/Clear of bits in
+// those take the stripe's lock too; a layout with narrower or wider leaves
+// keeps every materialized leaf a bitmap leaf.
+func NewAtomic(levelBits []uint) (Bitset, error) {
+
+	t, err := newConcurrent(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.lockFree = true
+
+	return t, nil
+}
+
+// leafOf descends the tree to the bitmap leaf holding the index, returning
+// it along with its level and the index within it; returns a nil leaf if a
+// sparse node (or an array/run leaf) is found on the way
+func (t *bitset) leafOf(idx uint64) (n *leaf, l *level, i uint64) {
+
+	next, l := t.root, t.rootLevel
+
+	for !l.leaf {
+
+		in, ok := next.(*inode)
+
+		if !ok {
+			return nil, l, idx
+		}
+
+		next, idx, l = in.nodes[idx>>l.shift], idx&l.mask, l.next
+	}
+
+	n, _ = next.(*leaf)
+
+	return n, l, idx
+}
+
+// addCounts atomically adds delta to the count of the bitset, and to that of
+// the inodes on the path to the (materialized, owned) leaf holding idx; the
+// inodes are owned as well, since they are the parents of an owned leaf
+func (t *bitset) addCounts(idx, delta uint64) {
+
+	atomic.AddUint64(&t.count, delta)
+
+	for next, l := t.root, t.rootLevel; !l.leaf; l = l.next {
+
+		in := next.(*inode)
+		atomic.AddUint64(&in.numSet, delta)
+
+		next, idx = in.nodes[idx>>l.shift], idx&l.mask
+	}
+}
+
+// addNumSet atomically adds delta to the leaf's numSet, returning the result
+func (n *leaf) addNumSet(delta int) int {
+
+	if unsafe.Sizeof(n.numSet) == 4 {
+		return int(atomic.AddInt32((*int32)(unsafe.Pointer(&n.numSet)), int32(delta)))
+	}
+
+	return int(atomic.AddInt64((*int64)(unsafe.Pointer(&n.numSet)), int64(delta)))
+}
+
+// reserveNumSet atomically adds delta (1 or -1) to the leaf's numSet, unless
+// that would make it reach 'limit' (all-set or all-clr, so the leaf would
+// need to be sparsified, under the exclusive lock); returns whether it was
+// added. The numSet is reserved before the bit is changed, and never reaches
+// the limit, so a materialized leaf is never left all-set or all-clr.
+func (n *leaf) reserveNumSet(delta, limit int) bool {
+
+	for {
+		var c int
+
+		if unsafe.Sizeof(n.numSet) == 4 {
+			c = int(atomic.LoadInt32((*int32)(unsafe.Pointer(&n.numSet))))
+		} else {
+			c = int(atomic.LoadInt64((*int64)(unsafe.Pointer(&n.numSet))))
+		}
+
+		// reaching the limit (or passing it, with changes in flight)
+		if delta > 0 && c+delta >= limit || delta < 0 && c+delta <= limit {
+			return false
+		}
+
+		var ok bool
+
+		if unsafe.Sizeof(n.numSet) == 4 {
+			ok = atomic.CompareAndSwapInt32((*int32)(unsafe.Pointer(&n.numSet)), int32(c), int32(c+delta))
+		} else {
+			ok = atomic.CompareAndSwapInt64((*int64)(unsafe.Pointer(&n.numSet)), int64(c), int64(c+delta))
+		}
+
+		if ok {
+			return true
+		}
+	}
+}
+
+// testAtomic is Test, for when the leaf words may be concurrently modified
+// by setAtomic/clrAtomic; the caller must hold at least a read lock
+func (t *bitset) testAtomic(idx uint64) bool {
+
+	n, _, i := t.leafOf(idx)
+
+	if n == nil {
+		return t.Test(idx) // sparse node or array/run leaf, not modified lock-free
+	}
+
+	bindex, bmask := int(i/64), uint64(1)<<(i%64)
+
+	return atomic.LoadUint64(&n.bits[bindex])&bmask != 0
+}
+
+// setAtomic sets the bit, if it's in a materialized leaf that this bitset
+// owns, and setting it would not fill up the leaf; returns ok=false if the
+// bit needs to be set with Set, under an exclusive lock. The caller must
+// hold at least a read lock.
+func (t *bitset) setAtomic(idx uint64) (set, ok bool) {
+	return t.changeAtomic(idx, true)
+}
+
+// clrAtomic is setAtomic, for clearing the bit
+func (t *bitset) clrAtomic(idx uint64) (cleared, ok bool) {
+	return t.changeAtomic(idx, false)
+}
+
+// changeAtomic sets/clears the bit (see setAtomic): the bit is only changed
+// when it's seen in the other state, after reserving the change in the
+// leaf's numSet (see reserveNumSet); if the word changed in the meantime,
+// the reservation is returned, and the bit looked at again
+func (t *bitset) changeAtomic(idx uint64, set bool) (changed, ok bool) {
+
+	n, l, i := t.leafOf(idx)
+
+	// sparse node, array/run leaf, or leaf shared with a clone (copy-on-write)
+	if n == nil || !l.owns(n.owner) {
+		return false, false
+	}
+
+	delta, limit := 1, l.total
+
+	if !set {
+		delta, limit = -1, 0
+	}
+
+	bindex, bmask := int(i/64), uint64(1)<<(i%64)
+
+	for {
+		old := atomic.LoadUint64(&n.bits[bindex])
+
+		if (old&bmask != 0) == set {
+			return false, true // already set/clear
+		}
+
+		if !n.reserveNumSet(delta, limit) {
+			return false, false
+		}
+
+		if atomic.CompareAndSwapUint64(&n.bits[bindex], old, old^bmask) {
+			break
+		}
+
+		n.addNumSet(-delta)
+	}
+
+	t.addCounts(idx, uint64(delta)) // NB: -1 wraps to a decrement
+
+	return true, true
+}
@@ -1,12 +1,13 @@
 package bitset_test
 
 import (
-	"bitset"
 	"fmt"
 	"math"
 	"math/rand"
+	"slices"
 	"testing"
 
+	"github.com/kirg/bitset"
 	wb "github.com/willf/bitset"
 )
 
@@ -46,3 +47,314 @@ func BenchmarkBitsetSet(bench *testing.B) {
 		}
 	})
 }
+
+// BenchmarkNewForCapacity populates bitsets of a fixed capacity at various
+// densities, comparing the layout picked by ChooseLayout (for each hint)
+// against the hand-tuned layouts (see B/op for the memory used)
+func BenchmarkNewForCapacity(bench *testing.B) {
+
+	const max = 1<<24 - 1
+
+	for _, expected := range []uint64{1 << 8, 1 << 14, 1 << 20} {
+
+		layouts := [][]uint{
+			{16, 8},
+			{8, 8, 8},
+			{4, 4, 4, 4, 4, 4},
+		}
+
+		for _, hint := range []bitset.LayoutHint{bitset.HintBalanced, bitset.HintMemory, bitset.HintSpeed} {
+			layouts = append(layouts, bitset.ChooseLayout(max, expected, hint).LevelBits)
+		}
+
+		for _, cfg := range layouts {
+
+			bench.Run(fmt.Sprintf("n=%d/%v", expected, cfg), func(bench *testing.B) {
+
+				bench.ReportAllocs()
+
+				for i := 0; i < bench.N; i++ {
+
+					r := rand.New(rand.NewSource(1))
+					b := bitset.New(cfg)
+
+					for j := uint64(0); j < expected; j++ {
+						b.Set(uint64(r.Int63n(max + 1)))
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkConcurrentSetParallel sets bits from parallel goroutines, into
+// leaves that are already materialized (and stay mixed)
+func BenchmarkConcurrentSetParallel(bench *testing.B) {
+
+	news := []struct {
+		name string
+		new  func(levelBits []uint) (bitset.Bitset, error)
+	}{
+		{"mutex", bitset.NewConcurrent},
+		{"atomic", bitset.NewAtomic},
+	}
+
+	for _, n := range news {
+
+		b, _ := n.new([]uint{10, 6, 8})
+
+		// materialize all leaves, with one bit clear in each
+		b.SetAll()
+
+		for i := uint64(0); i <= b.Max(); i += 1 << 10 {
+			b.Clear(i)
+		}
+
+		bench.Run(n.name, func(bench *testing.B) {
+
+			bench.ReportAllocs()
+
+			bench.RunParallel(func(pb *testing.PB) {
+
+				r := rand.New(rand.NewSource(rand.Int63()))
+
+				for pb.Next() {
+
+					i := uint64(r.Int63n(int64(b.Max())))
+
+					if i&0x3ff == 0 {
+						continue
+					}
+
+					b.Clear(i)
+					b.Set(i)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkBitsetIterate steps through the set bits of a sparse bitset, with
+// an Iterator and with repeated NextSet calls (which descend from the root)
+func BenchmarkBitsetIterate(bench *testing.B) {
+
+	b := bitset.New([]uint{8, 8, 8, 8})
+
+	for i := 0; i < 1<<16; i++ {
+		b.Set(uint64(rand.Int31()))
+	}
+
+	bench.Run("Iterator", func(bench *testing.B) {
+
+		it := b.Iterator()
+
+		for i := 0; i < bench.N; i++ {
+
+			if _, found := it.Next(); !found {
+				it.Reset()
+			}
+		}
+	})
+
+	bench.Run("NextSet", func(bench *testing.B) {
+
+		var idx uint64
+
+		for i := 0; i < bench.N; i++ {
+
+			var found bool
+
+			if idx, found = b.NextSet(idx + 1); !found {
+				idx = 0
+			}
+		}
+	})
+}
+
+// BenchmarkBitsetScan walks the set bits of a mixed-density bitset (about
+// one bit in 16 set, so leaves are neither full nor empty) with NextSet,
+// against willf/bitset
+func BenchmarkBitsetScan(bench *testing.B) {
+
+	const max = 1<<20 - 1
+
+	b := bitset.New([]uint{12, 8})
+	b2 := wb.New(max + 1)
+
+	for i := 0; i < (max+1)/16; i++ {
+		idx := rand.Intn(max + 1)
+		b.Set(uint64(idx))
+		b2.Set(uint(idx))
+	}
+
+	bench.Run("NextSet", func(bench *testing.B) {
+
+		var idx uint64
+
+		for i := 0; i < bench.N; i++ {
+
+			var found bool
+
+			if idx, found = b.NextSet(idx + 1); !found {
+				idx = 0
+			}
+		}
+	})
+
+	bench.Run("willf:NextSet", func(bench *testing.B) {
+
+		var idx uint
+
+		for i := 0; i < bench.N; i++ {
+
+			var found bool
+
+			if idx, found = b2.NextSet(idx + 1); !found {
+				idx = 0
+			}
+		}
+	})
+
+	bench.Run("CountRange", func(bench *testing.B) {
+
+		for i := 0; i < bench.N; i++ {
+			b.CountRange(uint64(i)&0xffff, max-uint64(i)&0xffff)
+		}
+	})
+
+	bench.Run("Rank", func(bench *testing.B) {
+
+		for i := 0; i < bench.N; i++ {
+			b.Rank(uint64(i) & max)
+		}
+	})
+
+	bench.Run("Select", func(bench *testing.B) {
+
+		count := b.Count()
+
+		for i := 0; i < bench.N; i++ {
+			b.Select(uint64(i) % count)
+		}
+	})
+
+	bench.Run("willf:Count", func(bench *testing.B) {
+
+		for i := 0; i < bench.N; i++ {
+			b2.Count()
+		}
+	})
+}
+
+// BenchmarkBitsetFromSorted loads sorted indexes (a mix of sparse bits and
+// dense runs) with FromSorted, against a Set per index
+func BenchmarkBitsetFromSorted(bench *testing.B) {
+
+	cfg := []uint{16, 8, 8}
+
+	r := rand.New(rand.NewSource(1))
+
+	var idxs []uint64
+
+	for idx := uint64(0); len(idxs) < 1<<20; idx++ {
+
+		if r.Intn(64) == 0 {
+			idx += uint64(r.Intn(1 << 16))
+		}
+
+		idxs = append(idxs, idx)
+	}
+
+	bench.Run("FromSorted", func(bench *testing.B) {
+
+		bench.ReportAllocs()
+
+		for i := 0; i < bench.N; i++ {
+			bitset.FromSorted(cfg, idxs)
+		}
+	})
+
+	bench.Run("Set", func(bench *testing.B) {
+
+		bench.ReportAllocs()
+
+		for i := 0; i < bench.N; i++ {
+
+			b := bitset.New(cfg)
+
+			for _, idx := range idxs {
+				b.Set(idx)
+			}
+		}
+	})
+}
+
+// BenchmarkBitsetSetMany sets batches of clustered indexes with SetMany
+// (sorted, or not), against a Set per index
+func BenchmarkBitsetSetMany(bench *testing.B) {
+
+	cfg := []uint{8, 8, 8, 8}
+
+	r := rand.New(rand.NewSource(1))
+
+	batches := make([][]uint64, 64)
+
+	for i := range batches {
+
+		base := uint64(r.Int31())
+
+		for j := 0; j < 4096; j++ {
+			batches[i] = append(batches[i], base+uint64(r.Intn(1<<20)))
+		}
+	}
+
+	sorted := make([][]uint64, len(batches))
+
+	for i, batch := range batches {
+		sorted[i] = slices.Sorted(slices.Values(batch))
+	}
+
+	bench.Run("SetMany:sorted", func(bench *testing.B) {
+
+		bench.ReportAllocs()
+
+		for i := 0; i < bench.N; i++ {
+
+			bench.StopTimer()
+			b := bitset.New(cfg)
+			bench.StartTimer()
+
+			b.SetMany(sorted[i%len(sorted)])
+		}
+	})
+
+	bench.Run("SetMany:unsorted", func(bench *testing.B) {
+
+		bench.ReportAllocs()
+
+		for i := 0; i < bench.N; i++ {
+
+			bench.StopTimer()
+			b := bitset.New(cfg)
+			bench.StartTimer()
+
+			b.SetMany(batches[i%len(batches)])
+		}
+	})
+
+	bench.Run("Set", func(bench *testing.B) {
+
+		bench.ReportAllocs()
+
+		for i := 0; i < bench.N; i++ {
+
+			bench.StopTimer()
+			b := bitset.New(cfg)
+			bench.StartTimer()
+
+			for _, idx := range batches[i%len(batches)] {
+				b.Set(idx)
+			}
+		}
+	})
+}
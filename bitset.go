@@ -1,8 +1,11 @@
 package bitset
 
 import (
-	"fmt"
+	"errors"
+	"io"
+	"iter"
 	"math"
+	"math/bits"
 )
 
 type (
@@ -10,12 +13,21 @@ type (
 		Test(idx uint64) bool
 		Set(idx uint64) Bitset
 		Clear(idx uint64) Bitset
+		Flip(idx uint64) Bitset
+		TrySet(idx uint64) error
+		TryClear(idx uint64) error
 		Swap(idx uint64, set bool) (swapped bool)
 
 		Count() uint64
+		CountRange(start, end uint64) uint64
+		Rank(idx uint64) uint64
+		Select(n uint64) (idx uint64, found bool)
 		Max() uint64
 		Cap() uint64
 
+		Count128() (hi, lo uint64)
+		Cap128() (hi, lo uint64)
+
 		NextSet(start uint64) (idx uint64, found bool)
 		NextClear(start uint64) (idx uint64, found bool)
 
@@ -29,17 +41,30 @@ type (
 		SetAll() Bitset
 		ClearAll() Bitset
 
+		// the ForEach* methods search from the root for each index, so 'do'
+		// may modify the bitset (unlike the bitset of an Iterator)
 		ForEachSet(do func(idx uint64) bool) Bitset
 		ForEachClear(do func(idx uint64) bool) Bitset
 
 		ForEachSetRange(start, end uint64, do func(idx uint64) bool) Bitset
 		ForEachClearRange(start, end uint64, do func(idx uint64) bool) Bitset
 
+		Iterator() *Iterator
+
+		SetBits() iter.Seq[uint64]
+		Backward() iter.Seq[uint64]
+		Ranges() iter.Seq2[uint64, uint64]
+
 		// GetSetRanges(start, end uint64) []interval.Interval
 
-		// SetRange(start, end uint64) Bitset
-		// ClearRange(start, end uint64) Bitset
-		// FlipRange(start, end uint64) Bitset
+		SetRange(start, end uint64) Bitset
+		ClearRange(start, end uint64) Bitset
+		FlipRange(start, end uint64) Bitset
+
+		SetMany(idxs []uint64) (changed uint64)
+		ClearMany(idxs []uint64) (changed uint64)
+		TestMany(idxs []uint64, out []bool)
+
 		// NextSetRange(start, end uint64) (idx uint64, found bool)
 		// NextClearRange(start, end uint64) (idx uint64, found bool)
 		// PrevSetRange(start, end uint64) (idx uint64, found bool)
@@ -48,15 +73,37 @@ type (
 		// AllRange(start, end uint64) bool
 		// NoneRange(start, end uint64) bool
 
-		// And(b Bitset) Bitset
-		// Or(b Bitset) Bitset
-		// Xor(b Bitset) Bitset
-		// Not() Bitset
+		And(b Bitset) (Bitset, error)
+		Or(b Bitset) (Bitset, error)
+		Xor(b Bitset) (Bitset, error)
+		AndNot(b Bitset) (Bitset, error)
+		Not() Bitset
+
+		InPlaceAnd(b Bitset) error
+		InPlaceOr(b Bitset) error
+		InPlaceXor(b Bitset) error
+		InPlaceAndNot(b Bitset) error
+
+		IntersectionCount(b Bitset) (uint64, error)
+		UnionCount(b Bitset) (uint64, error)
+		XorCount(b Bitset) (uint64, error)
+		DifferenceCount(b Bitset) (uint64, error)
+
 		// Equal(b Bitset) bool
 
-		// Clone() Bitset
+		Clone() Bitset
+
+		MarshalBinary() ([]byte, error)
+		UnmarshalBinary(data []byte) error
+		WriteTo(w io.Writer) (int64, error)
+		ReadFrom(r io.Reader) (int64, error)
+
+		ExportRoaring(w io.Writer) (int64, error)
+		ExportRoaring64(w io.Writer) (int64, error)
 
-		Stats() []int // #stats
+		Stats() Stats
+		Validate() error
+		Dump(w io.Writer, format DumpFormat) error
 	}
 )
 
@@ -69,30 +116,83 @@ type (
 	}
 )
 
+var (
+	// ErrEmptyLayout is returned when no levels are specified
+	ErrEmptyLayout = errors.New("bitset: empty level layout")
+
+	// ErrEmptyLeaf is returned when the leaf level is allocated zero bits
+	ErrEmptyLeaf = errors.New("bitset: zero bits allocated to leaf level")
+
+	// ErrTooManyBits is returned when the levels add up to more than 64 bits
+	ErrTooManyBits = errors.New("bitset: level layout exceeds 64 bits")
+
+	// ErrLevelTooWide is returned when a level has too many bits for the
+	// nodes (or the bits of a leaf) to be indexed by an int
+	ErrLevelTooWide = errors.New("bitset: level too wide to index with an int")
+
+	// ErrOutOfRange is returned when an index is beyond Max()
+	ErrOutOfRange = errors.New("bitset: index out of range")
+)
+
+// New returns a new bitset with the given level layout (leaf level first),
+// or nil if the layout is invalid; see NewWithError.
 func New(levelBits []uint) Bitset {
 
-	rootLevel, max := initLevels(levelBits)
+	b, err := NewWithError(levelBits)
 
-	if rootLevel == nil {
+	if err != nil {
 		return nil
 	}
 
+	return b
+}
+
+// NewWithError returns a new bitset with the given level layout (leaf level
+// first), or an error describing why the layout is invalid.
+func NewWithError(levelBits []uint) (Bitset, error) {
+
+	rootLevel, max, err := initLevels(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
 	return &bitset{
 		root:      newNode(rootLevel, true, false),
 		rootLevel: rootLevel,
 		max:       max,
-	}
+	}, nil
 }
 
 func (t *bitset) Max() uint64 {
 	return t.max
 }
 
+// Cap returns the number of bits in the bitset; a layout of 64 bits has a
+// capacity of 2^64, which is reported as math.MaxUint64 (see Cap128)
 func (t *bitset) Cap() uint64 {
-	return t.max + 1 // could overflow, if Max == math.MaxUint64!
+
+	if t.max == math.MaxUint64 {
+		return math.MaxUint64
+	}
+
+	return t.max + 1
+}
+
+// Cap128 returns the number of bits in the bitset, as a 128-bit number
+func (t *bitset) Cap128() (hi, lo uint64) {
+
+	lo, hi = bits.Add64(t.max, 1, 0)
+	return hi, lo
 }
 
+// Test returns whether the bit at idx is set; bits beyond Max() are clear
 func (t *bitset) Test(idx uint64) (ret bool) {
+
+	if idx > t.max {
+		return false
+	}
+
 	return t.root.test(t.rootLevel, idx)
 }
 
@@ -109,6 +209,8 @@ func (t *bitset) Set(idx uint64) Bitset {
 		if replace != t.root {
 			t.root = replace
 		}
+
+		t.debugValidate()
 	}
 
 	return t
@@ -127,8 +229,125 @@ func (t *bitset) Clear(idx uint64) Bitset {
 		if replace != t.root {
 			t.root = replace
 		}
+
+		t.debugValidate()
+	}
+
+	return t
+}
+
+// TrySet is like Set, but returns ErrOutOfRange if idx is beyond Max()
+func (t *bitset) TrySet(idx uint64) error {
+
+	if idx > t.max {
+		return ErrOutOfRange
+	}
+
+	t.Set(idx)
+
+	return nil
+}
+
+// TryClear is like Clear, but returns ErrOutOfRange if idx is beyond Max()
+func (t *bitset) TryClear(idx uint64) error {
+
+	if idx > t.max {
+		return ErrOutOfRange
+	}
+
+	t.Clear(idx)
+
+	return nil
+}
+
+// Flip flips the bit at idx; bits beyond Max() are left alone (they're all
+// clear, see Test)
+func (t *bitset) Flip(idx uint64) Bitset {
+
+	if idx > t.max {
+		return t
+	}
+
+	if t.root.test(t.rootLevel, idx) {
+		return t.Clear(idx)
+	}
+
+	return t.Set(idx)
+}
+
+// SetRange sets all bits in [start, end], up to Max(); subtrees that are
+// fully covered by the range are replaced with all-set sparse nodes
+func (t *bitset) SetRange(start, end uint64) Bitset {
+
+	if end > t.max {
+		end = t.max
+	}
+
+	if start > end {
+		return t
+	}
+
+	set, replace := t.root.setrange(t.rootLevel, start, end)
+
+	t.count += set
+
+	if replace != t.root {
+		t.root = replace
+	}
+
+	t.debugValidate()
+
+	return t
+}
+
+// ClearRange clears all bits in [start, end], up to Max(); subtrees that are
+// fully covered by the range are replaced with all-clr sparse nodes
+func (t *bitset) ClearRange(start, end uint64) Bitset {
+
+	if end > t.max {
+		end = t.max
+	}
+
+	if start > end {
+		return t
+	}
+
+	cleared, replace := t.root.clrrange(t.rootLevel, start, end)
+
+	t.count -= cleared
+
+	if replace != t.root {
+		t.root = replace
+	}
+
+	t.debugValidate()
+
+	return t
+}
+
+// FlipRange flips all bits in [start, end], up to Max(); sparse subtrees that
+// are fully covered by the range are swapped in place, without being
+// materialized
+func (t *bitset) FlipRange(start, end uint64) Bitset {
+
+	if end > t.max {
+		end = t.max
+	}
+
+	if start > end {
+		return t
 	}
 
+	set, cleared, replace := t.root.fliprange(t.rootLevel, start, end)
+
+	t.count += set - cleared
+
+	if replace != t.root {
+		t.root = replace
+	}
+
+	t.debugValidate()
+
 	return t
 }
 
@@ -139,32 +358,115 @@ func (t *bitset) Swap(idx uint64, set bool) bool {
 	}
 
 	var swapped bool
+	var replace node
 
 	if set {
-		if swapped, _ := t.root.set(t.rootLevel, idx); swapped {
+		if swapped, replace = t.root.set(t.rootLevel, idx); swapped {
 			t.count++
 		}
 	} else {
-		if swapped, _ := t.root.clr(t.rootLevel, idx); swapped {
+		if swapped, replace = t.root.clr(t.rootLevel, idx); swapped {
 			t.count--
 		}
 	}
 
+	if replace != t.root {
+		t.root = replace
+	}
+
+	t.debugValidate()
+
 	return swapped
 }
 
+// Clone returns a copy of the bitset that shares all of its nodes with the
+// original; either side copies a shared node only when it first modifies it.
+// The original is not modified (see level.share), so it can be cloned while
+// it's being read concurrently.
+func (t *bitset) Clone() Bitset {
+
+	// the clone gets new levels, so it owns none of the existing nodes, and
+	// the original no longer owns them either
+	t.rootLevel.share()
+
+	return &bitset{
+		root:      t.root,
+		rootLevel: cloneLevels(t.rootLevel),
+		count:     t.count,
+		max:       t.max,
+	}
+}
+
+// Count returns the number of bits set; with a layout of 64 bits, all bits
+// being set is reported as math.MaxUint64 (see Count128)
 func (t *bitset) Count() uint64 {
 
+	if t.full() {
+		return math.MaxUint64
+	}
+
 	return t.count
 }
 
+// CountRange returns the number of bits set in [start, end]
+func (t *bitset) CountRange(start, end uint64) uint64 {
+
+	if end > t.max {
+		end = t.max
+	}
+
+	switch {
+	case start > end:
+		return 0
+
+	case start == 0 && end == t.max:
+		return t.Count() // saturates, see full()
+	}
+
+	return t.root.countrange(t.rootLevel, start, end)
+}
+
+// Rank returns the number of bits set at or before idx; the inodes keep the
+// count of bits set under them, so only the path to idx is visited
+func (t *bitset) Rank(idx uint64) uint64 {
+	return t.CountRange(0, idx)
+}
+
+// Select returns the index of the n-th set bit, counting from 0
+func (t *bitset) Select(n uint64) (idx uint64, found bool) {
+
+	if n >= t.count && !t.full() {
+		return math.MaxUint64, false
+	}
+
+	return t.root.nthset(t.rootLevel, n), true
+}
+
+// Count128 returns the number of bits set, as a 128-bit number
+func (t *bitset) Count128() (hi, lo uint64) {
+
+	if t.full() {
+		return 1, 0
+	}
+
+	return 0, t.count
+}
+
+// full returns true if all 2^64 bits are set; the count is maintained modulo
+// 2^64, so it wraps to 0 in that case
+func (t *bitset) full() bool {
+
+	_, ok := t.root.(*setnode)
+	return ok && t.count == 0
+}
+
 func (t *bitset) NextSet(start uint64) (idx uint64, found bool) {
 
 	if start > t.max {
 		return math.MaxUint64, false
 	}
 
-	return t.root.nextset(t.rootLevel, start)
+	return t.root.nextset(t.rootLevel, start, t.max)
 }
 
 func (t *bitset) NextClear(start uint64) (idx uint64, found bool) {
@@ -173,7 +475,7 @@ func (t *bitset) NextClear(start uint64) (idx uint64, found bool) {
 		return math.MaxUint64, false
 	}
 
-	return t.root.nextclr(t.rootLevel, start)
+	return t.root.nextclr(t.rootLevel, start, t.max)
 }
 
 func (t *bitset) PrevSet(start uint64) (idx uint64, found bool) {
@@ -215,9 +517,11 @@ func (t *bitset) SetAll() Bitset {
 
 	if _, ok := t.root.(*setnode); !ok {
 		t.root = sparsify(t.rootLevel, t.root, true)
-		t.count = t.max + 1 // NB: could overflow!
+		t.count = t.max + 1 // NB: wraps to 0 with 64 bits, see full()
 	}
 
+	t.debugValidate()
+
 	return t
 }
 
@@ -228,164 +532,45 @@ func (t *bitset) ClearAll() Bitset {
 		t.count = 0
 	}
 
+	t.debugValidate()
+
 	return t
 }
 
 func (t *bitset) ForEachSet(do func(idx uint64) bool) Bitset {
-
-	for i := uint64(0); i <= t.max; i++ {
-
-		var found bool
-
-		i, found = t.root.nextset(t.rootLevel, i) // TODO: send down 'end' to terminate search sooner
-
-		if !found || !do(i) {
-			break // all done
-		}
-	}
-
-	return t
+	return t.ForEachSetRange(0, t.max, do)
 }
 
 func (t *bitset) ForEachClear(do func(idx uint64) bool) Bitset {
-
-	for i := uint64(0); i <= t.max; i++ {
-
-		var found bool
-
-		i, found = t.root.nextclr(t.rootLevel, i) // TODO: send down 'end' to terminate search sooner
-
-		if !found {
-			break // all done
-		}
-
-		if !do(i) {
-			break
-		}
-	}
-
-	return t
+	return t.ForEachClearRange(0, t.max, do)
 }
 
 func (t *bitset) ForEachSetRange(start, end uint64, do func(idx uint64) bool) Bitset {
-
-	if end > t.max {
-		end = t.max
-	}
-
-	for i := start; i <= end; i++ {
-
-		var found bool
-
-		i, found = t.root.nextset(t.rootLevel, start) // TODO: send down 'end' to terminate search sooner
-
-		if !found {
-			break // all done
-		}
-
-		if !do(i) {
-			break
-		}
-	}
-
-	return t
+	return t.forEachRange(start, end, node.nextset, do)
 }
 
 func (t *bitset) ForEachClearRange(start, end uint64, do func(idx uint64) bool) Bitset {
+	return t.forEachRange(start, end, node.nextclr, do)
+}
+
+// forEachRange calls 'do' for each index in [start, end] found by 'next',
+// which searches the tree only up to 'end'; each search starts again from the
+// root, so 'do' may modify the bitset
+func (t *bitset) forEachRange(start, end uint64, next func(n node, l *level, start, end uint64) (uint64, bool), do func(idx uint64) bool) Bitset {
 
 	if end > t.max {
 		end = t.max
 	}
 
-	for i := start; i <= end && i <= t.max; i++ {
+	for i := start; i <= end; i++ {
 
 		var found bool
 
-		i, found = t.root.nextclr(t.rootLevel, start) // TODO: send down 'end' to terminate search sooner
-
-		if !found {
+		// NB: stop at 'end' before incrementing, which may wrap around
+		if i, found = next(t.root, t.rootLevel, i, end); !found || !do(i) || i == end {
 			break // all done
 		}
-
-		if !do(i) {
-			break
-		}
 	}
 
 	return t
 }
-
-func (t *bitset) Stats() (numNodes []int) {
-
-	l := t.rootLevel
-
-	for {
-		numNodes = append(numNodes, l.numNodes)
-
-		if l.next == nil {
-			break
-		}
-
-		l = l.next
-	}
-
-	return
-}
-
-func dbg0(f string, a ...interface{}) {
-	// fmt.Printf(f, a...)
-}
-
-func dbg1(f string, a ...interface{}) {
-	fmt.Printf(f, a...)
-}
-
-func dbg2(f string, a ...interface{}) {
-	fmt.Printf(f, a...)
-}
-
-/*
-type BitSet interface {
-	All() bool
-	Any() bool
-	BinaryStorageSize() int
-	Bytes() []uint64
-	* Clear(i uint) *BitSet
-	ClearAll() *BitSet
-	Clone() *BitSet
-	Complement() (result *BitSet)
-	Copy(c *BitSet) (count uint)
-	Count() uint
-	Difference(compare *BitSet) (result *BitSet)
-	DifferenceCardinality(compare *BitSet) uint
-	DumpAsBits() string
-	Equal(c *BitSet) bool
-	Flip(i uint) *BitSet
-	InPlaceDifference(compare *BitSet)
-	InPlaceIntersection(compare *BitSet)
-	InPlaceSymmetricDifference(compare *BitSet)
-	InPlaceUnion(compare *BitSet)
-	Intersection(compare *BitSet) (result *BitSet)
-	IntersectionCardinality(compare *BitSet) uint
-	IsStrictSuperSet(other *BitSet) bool
-	IsSuperSet(other *BitSet) bool
-	Len() uint
-	MarshalBinary() ([]byte, error)
-	MarshalJSON() ([]byte, error)
-	NextClear(i uint) (uint, bool)
-	NextSet(i uint) (uint, bool)
-	None() bool
-	ReadFrom(stream io.Reader) (int64, error)
-	* Set(i uint) *BitSet
-	SetTo(i uint, value bool) *BitSet
-	String() string
-	SymmetricDifference(compare *BitSet) (result *BitSet)
-	SymmetricDifferenceCardinality(compare *BitSet) uint
-	* Test(i uint) bool
-	Union(compare *BitSet) (result *BitSet)
-	UnionCardinality(compare *BitSet) uint
-	UnmarshalBinary(data []byte) error
-	UnmarshalJSON(data []byte) error
-	WriteTo(stream io.Writer) (int64, error)
-}
-*/
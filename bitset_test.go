@@ -1,8 +1,14 @@
 package bitset
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"math"
+	"math/rand"
+	"runtime"
+	"slices"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -301,3 +307,1740 @@ func TestBitsetPrevClear(t *testing.T) {
 		})
 	}
 }
+
+func TestBitsetSetRangeClearRange(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b, ref := New(cfg), New(cfg)
+
+			max := b.Max()
+
+			ranges := [][2]uint64{
+				{0, 0},
+				{1, 70},
+				{max / 3, max/2 + 1},
+				{max / 4, max / 4},
+				{max - 100, max},
+				{0, max},
+			}
+
+			for _, r := range ranges {
+
+				if r[0] > max || r[0] > r[1] {
+					continue
+				}
+
+				if r[1] > max {
+					r[1] = max
+				}
+
+				assert.NotNil(t, b.SetRange(r[0], r[1]))
+
+				for i := r[0]; i <= r[1]; i++ {
+					ref.Set(i)
+				}
+
+				assert.EqualValues(t, ref.Count(), b.Count())
+				assert.EqualValues(t, ref.Stats().NumNodes(), b.Stats().NumNodes())
+				assert.EqualValues(t, true, b.Test(r[0]))
+				assert.EqualValues(t, true, b.Test(r[1]))
+
+				assert.NotNil(t, b.ClearRange(r[0]+1, r[1]))
+
+				for i := r[0] + 1; i <= r[1]; i++ {
+					ref.Clear(i)
+				}
+
+				assert.EqualValues(t, ref.Count(), b.Count())
+				assert.EqualValues(t, ref.Stats().NumNodes(), b.Stats().NumNodes())
+				assert.EqualValues(t, true, b.Test(r[0]))
+
+				for i, found := ref.NextSet(0); found; i, found = ref.NextSet(i + 1) {
+					assert.EqualValues(t, true, b.Test(i))
+				}
+			}
+
+			assert.NotNil(t, b.SetRange(0, math.MaxUint64))
+			assert.EqualValues(t, true, b.All())
+			assert.EqualValues(t, b.Cap(), b.Count())
+
+			assert.NotNil(t, b.ClearRange(0, max))
+			assert.EqualValues(t, true, b.None())
+			assert.EqualValues(t, 0, b.Count())
+
+			// beyond Max(), a no-op that can still be chained
+			assert.EqualValues(t, 0, b.SetRange(max+1, max+1).Count())
+			assert.EqualValues(t, 1, b.Set(max).FlipRange(max, math.MaxUint64).SetRange(max, max+1).Count())
+		})
+	}
+}
+
+func TestBitsetRangeCoversMaterialized(t *testing.T) {
+
+	b := New([]uint{8, 4, 4}).(*bitset)
+
+	// a materialized inode child (of 4096 bits), over a few leaves
+	b.Set(1).Set(300).SetRange(600, 700).Set(1000)
+	c := b.Clone()
+
+	// covering it -> a sparse child, counted without visiting its leaves
+	b.SetRange(0, 4095)
+	assert.IsType(t, &setnode{}, b.root.(*inode).nodes[0])
+	assert.EqualValues(t, 4096, b.Count())
+	assert.EqualValues(t, []int{1, 0, 0}, b.Stats().NumNodes())
+
+	c.ClearRange(0, 4095).Set(5000)
+	assert.IsType(t, &clrnode{}, c.(*bitset).root.(*inode).nodes[0])
+	assert.EqualValues(t, 1, c.Count())
+
+	// and a partial range still covers whole leaves under the child
+	d := New([]uint{8, 4, 4}).Set(1).Set(300).Set(1000).ClearRange(0, 511)
+	assert.EqualValues(t, 1, d.Count())
+	assert.EqualValues(t, []int{1, 1, 1}, d.Stats().NumNodes())
+
+	for _, x := range []Bitset{b, c, d} {
+		assert.NoError(t, x.Validate())
+	}
+}
+
+func TestBitsetFlipFlipRange(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b, ref := New(cfg), New(cfg)
+
+			max := b.Max()
+
+			i := max / 2
+			assert.NotNil(t, b.Flip(i))
+			assert.EqualValues(t, true, b.Test(i))
+			assert.EqualValues(t, 1, b.Count())
+			assert.NotNil(t, b.Flip(i))
+			assert.EqualValues(t, false, b.Test(i))
+			assert.EqualValues(t, 0, b.Count())
+			assert.Equal(t, b, b.Flip(max+1))
+
+			ranges := [][2]uint64{
+				{0, max / 2},
+				{max / 3, max},
+				{1, 70},
+				{0, max},
+			}
+
+			for _, r := range ranges {
+
+				if r[1] > max {
+					r[1] = max
+				}
+
+				assert.NotNil(t, b.FlipRange(r[0], r[1]))
+
+				for i := r[0]; i <= r[1]; i++ {
+					if ref.Test(i) {
+						ref.Clear(i)
+					} else {
+						ref.Set(i)
+					}
+				}
+
+				assert.EqualValues(t, ref.Count(), b.Count())
+				assert.EqualValues(t, ref.Stats().NumNodes(), b.Stats().NumNodes())
+
+				for i, found := ref.NextSet(0); found; i, found = ref.NextSet(i + 1) {
+					assert.EqualValues(t, true, b.Test(i))
+				}
+			}
+
+			assert.NotNil(t, b.ClearAll().FlipRange(0, max))
+			assert.EqualValues(t, true, b.All())
+			assert.NotNil(t, b.FlipRange(0, max))
+			assert.EqualValues(t, true, b.None())
+		})
+	}
+}
+
+func TestBitsetFlipRangeSparse(t *testing.T) {
+
+	b := New([]uint{16, 12, 12})
+
+	b.Set(12345).SetRange(1<<20, 1<<30)
+
+	count := b.Count()
+	stats := b.Stats().NumNodes()
+
+	assert.NotNil(t, b.FlipRange(0, b.Max()))
+	assert.EqualValues(t, b.Cap()-count, b.Count())
+	assert.EqualValues(t, stats, b.Stats().NumNodes())
+	assert.EqualValues(t, false, b.Test(12345))
+	assert.EqualValues(t, true, b.Test(12346))
+	assert.EqualValues(t, false, b.Test(1<<30))
+
+	assert.NotNil(t, b.FlipRange(0, b.Max()))
+	assert.EqualValues(t, count, b.Count())
+	assert.EqualValues(t, stats, b.Stats().NumNodes())
+}
+
+func TestBitsetSetOps(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			a, b := New(cfg), New(cfg)
+
+			max := a.Max()
+
+			a.SetRange(max/8, max/2).Set(3).Set(max)
+			b.SetRange(max/4, max-max/4).Set(5).Set(max)
+
+			ops := []struct {
+				name    string
+				op      func(a, b Bitset) (Bitset, error)
+				inPlace func(a, b Bitset) error
+				count   func(a, b Bitset) (uint64, error)
+				want    func(x, y bool) bool
+			}{
+				{"and", Bitset.And, Bitset.InPlaceAnd, Bitset.IntersectionCount, func(x, y bool) bool { return x && y }},
+				{"or", Bitset.Or, Bitset.InPlaceOr, Bitset.UnionCount, func(x, y bool) bool { return x || y }},
+				{"xor", Bitset.Xor, Bitset.InPlaceXor, Bitset.XorCount, func(x, y bool) bool { return x != y }},
+				{"andnot", Bitset.AndNot, Bitset.InPlaceAndNot, Bitset.DifferenceCount, func(x, y bool) bool { return x && !y }},
+			}
+
+			for _, o := range ops {
+
+				countA, countB := a.Count(), b.Count()
+
+				r, err := o.op(a, b)
+				assert.NoError(t, err, o.name)
+
+				// operands are left unmodified
+				assert.EqualValues(t, countA, a.Count(), o.name)
+				assert.EqualValues(t, countB, b.Count(), o.name)
+
+				var count uint64
+
+				for i := uint64(0); i <= max; i++ {
+
+					want := o.want(a.Test(i), b.Test(i))
+
+					if want {
+						count++
+					}
+
+					if r.Test(i) != want {
+						assert.Failf(t, "mismatch", "%s: idx=%d want=%v", o.name, i, want)
+						break
+					}
+				}
+
+				assert.EqualValues(t, count, r.Count(), o.name)
+
+				n, err := o.count(a, b)
+				assert.NoError(t, err, o.name)
+				assert.EqualValues(t, count, n, o.name)
+
+				c := New(cfg)
+				assert.NoError(t, c.InPlaceOr(a), o.name)
+				assert.NoError(t, o.inPlace(c, b), o.name)
+				assert.EqualValues(t, r.Count(), c.Count(), o.name)
+				assert.EqualValues(t, r.Stats().NumNodes(), c.Stats().NumNodes(), o.name)
+			}
+
+			n := a.Not()
+			assert.EqualValues(t, a.Cap()-a.Count(), n.Count())
+			assert.EqualValues(t, !a.Test(3), n.Test(3))
+
+			assert.NoError(t, a.InPlaceXor(a))
+			assert.EqualValues(t, true, a.None())
+		})
+	}
+}
+
+func TestBitsetSetOpsLayoutMismatch(t *testing.T) {
+
+	a, b := New([]uint{8, 8}), New([]uint{4, 12})
+
+	_, err := a.And(b)
+	assert.Equal(t, ErrLayoutMismatch, err)
+
+	assert.Equal(t, ErrLayoutMismatch, a.InPlaceOr(b))
+	assert.Equal(t, ErrLayoutMismatch, a.InPlaceXor(New([]uint{8, 8, 8})))
+
+	_, err = a.UnionCount(b)
+	assert.Equal(t, ErrLayoutMismatch, err)
+}
+
+func TestBitsetClone(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+
+			max := b.Max()
+
+			b.SetRange(max/2, max-max/4).Set(0).Set(max)
+
+			count, stats := b.Count(), b.Stats().NumNodes()
+
+			c := b.Clone()
+			assert.EqualValues(t, count, c.Count())
+			assert.EqualValues(t, stats, c.Stats().NumNodes())
+
+			// modify the clone, original should be unaffected
+			c.Clear(0).Set(1).ClearRange(max/2, max/2+max/8).FlipRange(max-max/8, max)
+			assert.True(t, c.Swap(2, true))
+
+			assert.EqualValues(t, count, b.Count())
+			assert.EqualValues(t, stats, b.Stats().NumNodes())
+			assert.EqualValues(t, true, b.Test(0))
+			assert.EqualValues(t, false, b.Test(1))
+			assert.EqualValues(t, false, b.Test(2))
+			assert.EqualValues(t, true, b.Test(max/2))
+			assert.EqualValues(t, true, b.Test(max))
+
+			assert.EqualValues(t, false, c.Test(0))
+			assert.EqualValues(t, true, c.Test(1))
+			assert.EqualValues(t, true, c.Test(2))
+			assert.EqualValues(t, false, c.Test(max/2))
+			assert.EqualValues(t, false, c.Test(max))
+
+			// modify the original, clone should be unaffected
+			count, stats = c.Count(), c.Stats().NumNodes()
+
+			b.ClearAll().Set(max / 3)
+			assert.EqualValues(t, count, c.Count())
+			assert.EqualValues(t, stats, c.Stats().NumNodes())
+			assert.EqualValues(t, true, c.Test(1))
+		})
+	}
+}
+
+func TestBitsetCloneSharing(t *testing.T) {
+
+	b := New([]uint{8, 8, 8})
+
+	for i := uint64(0); i < b.Max(); i += 255 {
+		b.Set(i)
+	}
+
+	rootLevel := b.(*bitset).rootLevel
+
+	c := b.Clone()
+	c.Set(1)
+
+	// the original keeps its levels (and nodes), only its owners are shared
+	assert.True(t, rootLevel == b.(*bitset).rootLevel)
+	assert.True(t, rootLevel.owner.shared.Load())
+
+	broot, croot := b.(*bitset).root.(*inode), c.(*bitset).root.(*inode)
+
+	assert.True(t, broot != croot)
+	assert.True(t, broot.nodes[0] != croot.nodes[0])
+
+	for i := 1; i < len(broot.nodes); i++ {
+		assert.True(t, broot.nodes[i] == croot.nodes[i], "subtree %d should be shared", i)
+	}
+}
+
+func TestBitsetCloneConcurrentReaders(t *testing.T) {
+
+	b := New([]uint{8, 8, 8})
+	b.SetRange(100, 20099).Set(40000)
+
+	var wg sync.WaitGroup
+
+	// Clone (and the ops that clone the receiver) only read the original, so
+	// they can run concurrently (see go test -race)
+	for i := 0; i < 8; i++ {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+
+			c, err := b.Or(b)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 20001, c.Count())
+
+			assert.EqualValues(t, 20002, b.Clone().Set(1).Count())
+			assert.EqualValues(t, 20001, b.Count())
+		}()
+	}
+
+	wg.Wait()
+
+	// the original's nodes are shared, so they're copied when modified
+	b.Clear(100)
+	assert.EqualValues(t, 20000, b.Count())
+	assert.NoError(t, b.Validate())
+}
+
+func TestBitsetSwap(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+
+			i := b.Max() / 2
+
+			assert.EqualValues(t, true, b.Swap(i, true))
+			assert.EqualValues(t, false, b.Swap(i, true))
+			assert.EqualValues(t, true, b.Test(i))
+			assert.EqualValues(t, 1, b.Count())
+
+			assert.EqualValues(t, true, b.Swap(i, false))
+			assert.EqualValues(t, false, b.Swap(i, false))
+			assert.EqualValues(t, false, b.Test(i))
+			assert.EqualValues(t, true, b.None())
+		})
+	}
+}
+
+func TestBitsetMarshalUnmarshal(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+
+			max := b.Max()
+
+			b.SetRange(max/4, max/2).Set(1).Set(max).Clear(max / 3)
+
+			data, err := b.MarshalBinary()
+			assert.NoError(t, err)
+
+			c := New([]uint{8})
+			assert.NoError(t, c.UnmarshalBinary(data))
+
+			assert.EqualValues(t, b.Max(), c.Max())
+			assert.EqualValues(t, b.Count(), c.Count())
+			assert.EqualValues(t, b.Stats().NumNodes(), c.Stats().NumNodes())
+
+			for i, found := b.NextSet(0); found; i, found = b.NextSet(i + 1) {
+				assert.EqualValues(t, true, c.Test(i))
+			}
+
+			// truncated, or with trailing data
+			assert.Error(t, c.UnmarshalBinary(data[:len(data)-1]))
+			assert.Error(t, c.UnmarshalBinary(append(data, 0)))
+		})
+	}
+}
+
+func TestBitsetWriteToReadFrom(t *testing.T) {
+
+	b := New([]uint{8, 8, 8})
+
+	b.SetRange(1000, 100000).Set(7)
+
+	var buf bytes.Buffer
+
+	n, err := b.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, buf.Len(), n)
+
+	// sparse subtrees should be encoded as a single byte each
+	assert.True(t, n < 1024, "encoding too large: %d", n)
+
+	// a second bitset written to the same stream
+	New([]uint{4, 4}).Set(3).WriteTo(&buf)
+
+	c := New([]uint{8})
+
+	m, err := c.ReadFrom(&buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, n, m)
+	assert.EqualValues(t, b.Count(), c.Count())
+	assert.EqualValues(t, true, c.Test(7))
+	assert.EqualValues(t, true, c.Test(100000))
+	assert.EqualValues(t, false, c.Test(100001))
+
+	_, err = c.ReadFrom(&buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 255, c.Max())
+	assert.EqualValues(t, 1, c.Count())
+
+	assert.Equal(t, ErrInvalidEncoding, c.UnmarshalBinary([]byte("BSET\x02\x01\x08\x00")))
+	assert.Equal(t, ErrInvalidEncoding, c.UnmarshalBinary([]byte("BSET\x01\x01\x08\x02")))
+
+	// headers with wide levels, and little data: memory is only allocated
+	// as the data arrives
+	var ms runtime.MemStats
+
+	runtime.ReadMemStats(&ms)
+	alloc := ms.TotalAlloc
+
+	for _, data := range []string{
+		"BSET\x01\x01\x28\x03\xff\xff\xff\xff\xff\xff\xff\xff", // 40-bit leaf
+		"BSET\x01\x02\x01\x30\x02\x00\x01\x00",                 // 48-bit inode
+	} {
+		assert.Equal(t, io.ErrUnexpectedEOF, c.UnmarshalBinary([]byte(data)), "%q", data)
+	}
+
+	runtime.ReadMemStats(&ms)
+	assert.True(t, ms.TotalAlloc-alloc < 1<<20, "allocated %d bytes", ms.TotalAlloc-alloc)
+}
+
+func TestBitsetSetOpsNarrowLeaf(t *testing.T) {
+
+	// leaves narrower than a word, desparsified from an all-set node
+	a, b := New([]uint{2, 2}), New([]uint{2, 2})
+
+	a.SetAll().Clear(0)
+	b.Set(1)
+
+	n, err := a.XorCount(b)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 14, n)
+
+	assert.NoError(t, a.InPlaceAnd(b))
+	assert.EqualValues(t, 1, a.Count())
+
+	// the popcounts of Or/Xor of leaves under 64 bits only see their bits
+	for _, cfg := range [][]uint{{1, 3}, {2, 2}, {5, 1}, {7, 5}} {
+
+		a, b := New(cfg), New(cfg)
+		max := a.Max()
+
+		a.SetAll().Clear(0).Clear(max)
+		b.Set(0).Set(1)
+
+		or, err := a.Or(b)
+		assert.NoError(t, err)
+		assert.EqualValues(t, max, or.Count(), "%v", cfg)
+		assert.NoError(t, or.Validate())
+
+		xor, err := a.Xor(b)
+		assert.NoError(t, err)
+		assert.EqualValues(t, max-1, xor.Count(), "%v", cfg)
+		assert.NoError(t, xor.Validate())
+
+		n, err := a.UnionCount(b)
+		assert.NoError(t, err)
+		assert.EqualValues(t, max, n, "%v", cfg)
+	}
+}
+
+func TestBitsetNewWithError(t *testing.T) {
+
+	tests := []struct {
+		levelBits []uint
+		err       error
+	}{
+		{nil, ErrEmptyLayout},
+		{[]uint{}, ErrEmptyLayout},
+		{[]uint{0, 8}, ErrEmptyLeaf},
+		{[]uint{32, 32, 1}, ErrTooManyBits},
+		{[]uint{65}, ErrTooManyBits},
+		{[]uint{63}, ErrLevelTooWide},
+		{[]uint{1, 63}, ErrLevelTooWide}, // 64 bits, but too wide a root
+		{[]uint{8, 8}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v", tt.levelBits), func(t *testing.T) {
+
+			b, err := NewWithError(tt.levelBits)
+			assert.Equal(t, tt.err, err)
+
+			if tt.err != nil {
+				assert.Nil(t, b)
+				assert.Nil(t, New(tt.levelBits))
+			} else {
+				assert.NotNil(t, b)
+			}
+		})
+	}
+}
+
+func TestBitsetTrySetTryClear(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+
+			i := b.Max()
+
+			assert.NoError(t, b.TrySet(i))
+			assert.EqualValues(t, true, b.Test(i))
+			assert.NoError(t, b.TryClear(i))
+			assert.EqualValues(t, false, b.Test(i))
+
+			assert.Equal(t, ErrOutOfRange, b.TrySet(i+1))
+			assert.Equal(t, ErrOutOfRange, b.TryClear(i+1))
+			assert.EqualValues(t, 0, b.Count())
+
+			// bits beyond Max() are clear, even with all the bits set (and
+			// with a single leaf level, which holds no bits beyond it)
+			b.SetAll()
+			assert.EqualValues(t, false, b.Test(i+1))
+			assert.EqualValues(t, false, b.Test(math.MaxUint64))
+			b.ClearAll().Set(i)
+			assert.EqualValues(t, false, b.Test(i+1))
+			assert.EqualValues(t, false, b.Test(i+64))
+		})
+	}
+}
+
+func TestBitsetChooseLayout(t *testing.T) {
+
+	maxes := []uint64{0, 1, 255, 1<<20 - 1, 1<<32 - 1, 1 << 40, math.MaxUint64}
+	hints := []LayoutHint{HintBalanced, HintMemory, HintSpeed}
+
+	for _, max := range maxes {
+		for _, expected := range []uint64{0, 1, 1 << 10, max / 4, max} {
+			for _, hint := range hints {
+
+				layout := ChooseLayout(max, expected, hint)
+
+				b, err := NewForCapacity(max, expected, hint)
+				assert.NoError(t, err, "%v", layout)
+				assert.True(t, b.Max() >= max, "%v", layout)
+				assert.NotEmpty(t, layout.Reason)
+
+				for _, bits := range layout.LevelBits[1:] {
+					assert.True(t, bits <= maxFanoutBits, "%v", layout)
+				}
+			}
+		}
+	}
+
+	// dense data gets wide leaves, and so does sparse data, whose leaves are
+	// small array leaves (of any width) under fewer inodes
+	assert.EqualValues(t, maxLeafBits, ChooseLayout(1<<32-1, 1<<31, HintMemory).LevelBits[0])
+	assert.True(t, ChooseLayout(1<<32-1, 1<<10, HintMemory).LevelBits[0] >= minAdaptiveLeafBits)
+
+	// a leaf with a few bits set is estimated as an array leaf when it's
+	// adaptive, and as a bitmap leaf otherwise
+	mixed := 1 - math.Pow(1-4.0/4096, 4096)
+	assert.InDelta(t, mixed*arrayLeafBytes+2*4, estimateBytes([]uint{12}, 4.0/4096), 1e-6)
+
+	mixed = 1 - math.Pow(1-4.0/64, 64)
+	assert.InDelta(t, mixed*(leafBytes+8), estimateBytes([]uint{6}, 4.0/64), 1e-6)
+
+	// speed prefers fewer levels than memory
+	assert.True(t, len(ChooseLayout(1<<32-1, 1<<10, HintSpeed).LevelBits) <
+		len(ChooseLayout(1<<32-1, 1<<10, HintMemory).LevelBits))
+}
+
+func TestBitsetFull64Bits(t *testing.T) {
+
+	b := New([]uint{16, 16, 16, 16})
+
+	assert.EqualValues(t, uint64(math.MaxUint64), b.Max())
+	assert.EqualValues(t, uint64(math.MaxUint64), b.Cap())
+
+	hi, lo := b.Cap128()
+	assert.EqualValues(t, 1, hi)
+	assert.EqualValues(t, 0, lo)
+
+	hi, lo = b.Count128()
+	assert.EqualValues(t, 0, hi)
+	assert.EqualValues(t, 0, lo)
+	assert.EqualValues(t, 0, b.Count())
+
+	b.SetAll()
+
+	hi, lo = b.Count128()
+	assert.EqualValues(t, 1, hi)
+	assert.EqualValues(t, 0, lo)
+	assert.EqualValues(t, uint64(math.MaxUint64), b.Count())
+
+	b.Clear(math.MaxUint64)
+
+	hi, lo = b.Count128()
+	assert.EqualValues(t, 0, hi)
+	assert.EqualValues(t, uint64(math.MaxUint64), lo)
+	assert.EqualValues(t, uint64(math.MaxUint64), b.Count())
+
+	idx, found := b.PrevSet(math.MaxUint64)
+	assert.EqualValues(t, true, found)
+	assert.EqualValues(t, uint64(math.MaxUint64-1), idx)
+
+	idx, found = b.NextClear(0)
+	assert.EqualValues(t, true, found)
+	assert.EqualValues(t, uint64(math.MaxUint64), idx)
+
+	b.Set(math.MaxUint64)
+	assert.EqualValues(t, true, b.All())
+
+	hi, lo = b.Count128()
+	assert.EqualValues(t, 1, hi)
+	assert.EqualValues(t, 0, lo)
+
+	b.FlipRange(0, math.MaxUint64)
+	assert.EqualValues(t, true, b.None())
+	assert.EqualValues(t, 0, b.Count())
+
+	b.SetRange(0, math.MaxUint64)
+	assert.EqualValues(t, true, b.All())
+	assert.EqualValues(t, uint64(math.MaxUint64), b.Count())
+
+	b.ClearRange(1<<63, math.MaxUint64)
+	assert.EqualValues(t, uint64(1<<63), b.Count())
+
+	// ranges covering the whole (sparse) root: the 2^64 bits changed wrap to
+	// 0, and the count with them
+	b.SetAll().ClearRange(0, math.MaxUint64)
+	assert.EqualValues(t, true, b.None())
+	assert.EqualValues(t, 0, b.Count())
+	assert.NoError(t, b.Validate())
+
+	b.FlipRange(0, math.MaxUint64)
+	assert.EqualValues(t, true, b.All())
+	assert.EqualValues(t, uint64(math.MaxUint64), b.Count())
+	assert.NoError(t, b.Validate())
+
+	b.SetRange(0, math.MaxUint64).Clear(5).SetRange(0, math.MaxUint64)
+	assert.EqualValues(t, true, b.All())
+
+	hi, lo = b.Count128()
+	assert.EqualValues(t, 1, hi)
+	assert.EqualValues(t, 0, lo)
+
+	b.ClearRange(0, 7)
+	assert.EqualValues(t, uint64(math.MaxUint64-7), b.Count())
+	assert.NoError(t, b.Validate())
+	// counts of ops with a full result saturate, like Count
+	lo1, hi1 := New([]uint{16, 16, 16, 16}), New([]uint{16, 16, 16, 16})
+	lo1.SetRange(0, 1<<63-1)
+	hi1.SetRange(1<<63, math.MaxUint64)
+
+	for _, c := range []struct {
+		name string
+		f    func(a, b Bitset) (uint64, error)
+		a, b Bitset
+		want uint64
+	}{
+		{"and", Bitset.IntersectionCount, b.SetAll(), b, math.MaxUint64},
+		{"or", Bitset.UnionCount, lo1, hi1, math.MaxUint64},
+		{"xor", Bitset.XorCount, lo1, hi1, math.MaxUint64},
+		{"xor self", Bitset.XorCount, b, b, 0},
+		{"andnot", Bitset.DifferenceCount, b, New([]uint{16, 16, 16, 16}), math.MaxUint64},
+		{"andnot self", Bitset.DifferenceCount, b, b, 0},
+		{"and halves", Bitset.IntersectionCount, lo1, hi1, 0},
+	} {
+		n, err := c.f(c.a, c.b)
+		assert.NoError(t, err, c.name)
+		assert.EqualValues(t, c.want, n, c.name)
+	}
+}
+
+func TestBitsetPrevSetSparseSubtree(t *testing.T) {
+
+	b := New([]uint{8, 8, 8})
+
+	// a sparse all-set subtree at an inode level
+	b.SetRange(1<<16, 2<<16-1)
+
+	idx, found := b.PrevSet(b.Max())
+	assert.EqualValues(t, true, found)
+	assert.EqualValues(t, 2<<16-1, idx)
+
+	b.SetAll().ClearRange(1<<16, 2<<16-1)
+
+	idx, found = b.PrevClear(b.Max())
+	assert.EqualValues(t, true, found)
+	assert.EqualValues(t, 2<<16-1, idx)
+}
+
+func TestBitsetIterator(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+			it := b.Iterator()
+
+			_, found := it.Next()
+			assert.EqualValues(t, false, found, "empty bitset")
+
+			_, found = it.Prev()
+			assert.EqualValues(t, false, found, "empty bitset")
+
+			// a mix of sparse set subtrees, leaves and single bits
+			max := b.Max()
+			b.SetRange(max/4, max/2).Set(1).Set(max).Clear(max / 3)
+
+			var want []uint64
+
+			for i, found := b.NextSet(0); found; i, found = b.NextSet(i + 1) {
+				want = append(want, i)
+				if i == max {
+					break
+				}
+			}
+
+			var got []uint64
+
+			it.Reset()
+			for i, found := it.Next(); found; i, found = it.Next() {
+				got = append(got, i)
+			}
+			assert.EqualValues(t, want, got, "forward")
+
+			// the iterator is now past the end; step back
+			got = got[:0]
+			for i, found := it.Prev(); found; i, found = it.Prev() {
+				got = append([]uint64{i}, got...)
+			}
+			assert.EqualValues(t, want, got, "backward")
+
+			// backward straight away, from a new iterator and a reset one
+			backward := func(it *Iterator) (got []uint64) {
+				for i, found := it.Prev(); found; i, found = it.Prev() {
+					got = append([]uint64{i}, got...)
+				}
+				return got
+			}
+
+			assert.EqualValues(t, want, backward(b.Iterator()), "backward from new")
+
+			it.Seek(max / 3)
+			it.Reset()
+			assert.EqualValues(t, want, backward(it), "backward from reset")
+
+			// once before the first set bit, it stays there
+			_, found = it.Prev()
+			assert.EqualValues(t, false, found, "prev before first")
+
+			for _, i := range []uint64{0, 1, 2, max / 4, max / 3, max/2 + 1, max} {
+
+				wantIdx, wantFound := b.NextSet(i)
+
+				idx, found := it.Seek(i)
+				assert.EqualValues(t, wantFound, found, "seek %d", i)
+
+				if !found {
+					continue
+				}
+
+				assert.EqualValues(t, wantIdx, idx, "seek %d", i)
+
+				wantIdx, wantFound = 0, false
+
+				if idx > 0 {
+					wantIdx, wantFound = b.PrevSet(idx - 1)
+				}
+
+				idx, found = it.Prev()
+				assert.EqualValues(t, wantFound, found, "prev after seek %d", i)
+				assert.EqualValues(t, wantIdx, idx, "prev after seek %d", i)
+			}
+		})
+	}
+}
+
+func TestBitsetIteratorSkipsEmptyLeaf(t *testing.T) {
+
+	b := New([]uint{8, 4}).(*bitset)
+
+	b.Set(3).Set(2<<8 + 7)
+
+	// bitmap leaf, then cleared behind the tree's back
+	for i := uint64(1 << 8); i < 2<<8; i += 2 {
+		b.Set(i)
+	}
+
+	l := b.root.(*inode).nodes[1].(*leaf)
+	clear(l.bits)
+
+	it := b.Iterator()
+
+	var got []uint64
+	for i, found := it.Next(); found; i, found = it.Next() {
+		got = append(got, i)
+	}
+	assert.EqualValues(t, []uint64{3, 2<<8 + 7}, got, "forward")
+
+	got = got[:0]
+	for i, found := it.Prev(); found; i, found = it.Prev() {
+		got = append([]uint64{i}, got...)
+	}
+	assert.EqualValues(t, []uint64{3, 2<<8 + 7}, got, "backward")
+}
+
+func TestBitsetSeq(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+			max := b.Max()
+
+			for range b.SetBits() {
+				t.Fatal("empty bitset")
+			}
+
+			b.SetRange(max/4, max/2).Set(1).Set(max).Clear(max / 3)
+
+			var want []uint64
+
+			for i, found := b.NextSet(0); found; i, found = b.NextSet(i + 1) {
+				want = append(want, i)
+				if i == max {
+					break
+				}
+			}
+
+			var got []uint64
+
+			for idx := range b.SetBits() {
+				got = append(got, idx)
+			}
+			assert.EqualValues(t, want, got, "forward")
+
+			got = got[:0]
+			for idx := range b.Backward() {
+				got = append([]uint64{idx}, got...)
+			}
+			assert.EqualValues(t, want, got, "backward")
+
+			// the runs cover exactly the set bits
+			got = got[:0]
+			for start, end := range b.Ranges() {
+
+				assert.EqualValues(t, true, start <= end)
+
+				if start > 0 {
+					assert.EqualValues(t, false, b.Test(start-1), "run starting at %d", start)
+				}
+				if end < max {
+					assert.EqualValues(t, false, b.Test(end+1), "run ending at %d", end)
+				}
+
+				for i := start; i <= end; i++ {
+					got = append(got, i)
+				}
+			}
+			assert.EqualValues(t, want, got, "ranges")
+
+			// breaking out early
+			for idx := range b.SetBits() {
+				assert.EqualValues(t, want[0], idx)
+				break
+			}
+			for idx := range b.Backward() {
+				assert.EqualValues(t, max, idx)
+				break
+			}
+		})
+	}
+}
+
+func TestBitsetForEachRange(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+			max := b.Max()
+
+			b.SetRange(max/4, max/2).Set(1).Set(max).Clear(max / 3)
+
+			ranges := [][2]uint64{
+				{0, max}, {1, 1}, {2, max / 4}, {max / 3, max/2 + 1},
+				{max/2 + 1, max - 1}, {max, max}, {max / 2, max / 4},
+			}
+
+			for _, r := range ranges {
+
+				var wantSet, wantClr, set, clr []uint64
+
+				for i := r[0]; i <= r[1]; i++ {
+
+					if b.Test(i) {
+						wantSet = append(wantSet, i)
+					} else {
+						wantClr = append(wantClr, i)
+					}
+
+					if i == max {
+						break
+					}
+				}
+
+				b.ForEachSetRange(r[0], r[1], func(idx uint64) bool {
+					set = append(set, idx)
+					return true
+				})
+
+				b.ForEachClearRange(r[0], r[1], func(idx uint64) bool {
+					clr = append(clr, idx)
+					return true
+				})
+
+				assert.EqualValues(t, wantSet, set, "set in %v", r)
+				assert.EqualValues(t, wantClr, clr, "clear in %v", r)
+			}
+
+			// stopping early
+			var n int
+
+			b.ForEachClearRange(0, max, func(idx uint64) bool {
+				n++
+				return false
+			})
+
+			assert.EqualValues(t, 1, n)
+		})
+	}
+}
+
+func TestBitsetForEachModify(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+			b.SetRange(0, min(b.Max(), 99))
+
+			// clear the successor of each bit as it is visited
+			var got []uint64
+
+			b.ForEachSet(func(idx uint64) bool {
+				got = append(got, idx)
+				if idx < b.Max() {
+					b.Clear(idx + 1)
+				}
+				return true
+			})
+
+			var want []uint64
+
+			for i := uint64(0); i <= min(b.Max(), 99); i += 2 {
+				want = append(want, i)
+			}
+
+			assert.EqualValues(t, want, got)
+			assert.NoError(t, b.Validate())
+		})
+	}
+}
+
+func TestBitsetCountRange(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+			max := b.Max()
+
+			b.SetRange(max/4, max/2).Set(1).Set(max).Clear(max / 3)
+
+			ranges := [][2]uint64{
+				{0, max}, {1, 1}, {2, max / 4}, {max / 3, max/2 + 1},
+				{max/2 + 1, max - 1}, {max, max}, {max / 2, max / 4},
+			}
+
+			for _, r := range ranges {
+
+				var want uint64
+
+				b.ForEachSetRange(r[0], r[1], func(idx uint64) bool {
+					want++
+					return true
+				})
+
+				assert.EqualValues(t, want, b.CountRange(r[0], r[1]), "count in %v", r)
+			}
+
+			assert.EqualValues(t, b.Count(), b.CountRange(0, math.MaxUint64))
+		})
+	}
+}
+
+func TestBitsetRankSelect(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			b := New(cfg)
+			max := b.Max()
+
+			_, found := b.Select(0)
+			assert.EqualValues(t, false, found, "empty bitset")
+			assert.EqualValues(t, 0, b.Rank(max))
+
+			b.SetRange(max/4, max/2).Set(1).Set(max).Clear(max / 3)
+			b.FlipRange(max/3, max/3+max/8).Flip(2)
+
+			// counts kept in the inodes, through clones, set ops and encoding
+			c := b.Clone().Clear(max/4 + 1)
+			b.Set(max / 5)
+
+			x, err := b.Xor(c)
+			assert.NoError(t, err)
+
+			data, err := x.MarshalBinary()
+			assert.NoError(t, err)
+
+			y := New(cfg)
+			assert.NoError(t, y.UnmarshalBinary(data))
+
+			for _, b := range []Bitset{b, c, x, y} {
+
+				var set []uint64
+
+				b.ForEachSet(func(idx uint64) bool {
+					set = append(set, idx)
+					return true
+				})
+
+				for n, want := range set {
+
+					idx, found := b.Select(uint64(n))
+					assert.EqualValues(t, true, found, "select %d", n)
+					assert.EqualValues(t, want, idx, "select %d", n)
+
+					assert.EqualValues(t, n+1, b.Rank(want), "rank %d", want)
+				}
+
+				_, found := b.Select(uint64(len(set)))
+				assert.EqualValues(t, false, found)
+
+				assert.EqualValues(t, len(set), b.Rank(max))
+				assert.EqualValues(t, 0, b.Rank(0))
+			}
+		})
+	}
+}
+
+func TestBitsetLeafKinds(t *testing.T) {
+
+	b := New([]uint{12, 4})
+	max := b.Max()
+
+	// at returns the node holding idx at the leaf level
+	at := func(b Bitset, idx uint64) node {
+		return b.(*bitset).root.(*inode).nodes[idx>>12]
+	}
+
+	// a few bits set in a leaf -> array leaf
+	b.Set(1).Set(100).Set(4000)
+	assert.IsType(t, &arrayleaf{}, at(b, 1))
+
+	// more than arrayMax bits set -> bitmap leaf
+	for i := uint64(0); i < 1<<12; i += 8 {
+		b.Set(i)
+	}
+	assert.IsType(t, &leaf{}, at(b, 1))
+	assert.EqualValues(t, 1<<9+2, b.Count())
+
+	// cleared down to well below arrayMax -> array leaf
+	b.ClearRange(0, 1<<12-1-1024)
+	assert.IsType(t, &arrayleaf{}, at(b, 1))
+
+	// a few bits cleared in an all-set leaf -> run leaf
+	b.SetRange(1<<12, 2<<12-1).Clear(1<<12 + 5).Clear(1<<12 + 6).Clear(2<<12 - 1)
+	assert.IsType(t, &runleaf{}, at(b, 1<<12))
+	assert.EqualValues(t, 1<<12-3, b.CountRange(1<<12, 2<<12-1))
+
+	// many short runs -> bitmap leaf
+	for i := uint64(1 << 12); i < 2<<12; i += 4 {
+		b.Clear(i)
+	}
+	assert.IsType(t, &leaf{}, at(b, 1<<12))
+
+	// a run leaf, built by a range op
+	b.SetRange(3<<12+10, 3<<12+1000)
+	assert.IsType(t, &runleaf{}, at(b, 3<<12))
+
+	// range ops on a bitmap leaf leave it a run/array leaf, when that's best
+	b.SetRange(1<<12, 2<<12-100)
+	assert.IsType(t, &runleaf{}, at(b, 1<<12))
+
+	for i := uint64(5 << 12); i < 5<<12+500; i += 2 {
+		b.Set(i)
+	}
+	b.SetRange(5<<12+1000, 5<<12+1999)
+	assert.IsType(t, &leaf{}, at(b, 5<<12))
+
+	b.FlipRange(5<<12+1000, 5<<12+1999)
+	assert.IsType(t, &arrayleaf{}, at(b, 5<<12))
+
+	// each kind behaves the same as a plain bitmap leaf
+	ref := New([]uint{6, 6, 4}) // leaves too narrow to be array/run leaves
+
+	b.ForEachSet(func(idx uint64) bool {
+		ref.Set(idx)
+		return true
+	})
+
+	check := func(b Bitset) {
+
+		assert.EqualValues(t, ref.Count(), b.Count())
+
+		for _, i := range []uint64{0, 1, 2, 99, 100, 101, 1 << 12, 1<<12 + 5, 1<<12 + 7, 2<<12 - 1, 3<<12 + 9, 3<<12 + 10, 3<<12 + 1000, max} {
+
+			assert.EqualValues(t, ref.Test(i), b.Test(i), "test %d", i)
+
+			for _, f := range []func(b Bitset, i uint64) (uint64, bool){
+				Bitset.NextSet, Bitset.NextClear, Bitset.PrevSet, Bitset.PrevClear, Bitset.Select,
+			} {
+				want, wantFound := f(ref, i)
+				got, found := f(b, i)
+				assert.EqualValues(t, wantFound, found, "%d", i)
+				assert.EqualValues(t, want, got, "%d", i)
+			}
+
+			assert.EqualValues(t, ref.Rank(i), b.Rank(i), "rank %d", i)
+		}
+	}
+
+	check(b)
+
+	// through set ops, encoding and clones
+	c := New([]uint{12, 4})
+	assert.NoError(t, c.InPlaceOr(b))
+	check(c)
+
+	data, err := b.MarshalBinary()
+	assert.NoError(t, err)
+
+	d := New([]uint{12, 4})
+	assert.NoError(t, d.UnmarshalBinary(data))
+	check(d)
+
+	e := b.Clone()
+	e.Flip(1).Flip(1<<12 + 8).Flip(3<<12 + 500).Flip(1).Flip(1<<12 + 8).Flip(3<<12 + 500)
+	check(b)
+	check(e)
+
+	// the stats account for all kinds of leaves
+	assert.EqualValues(t, []int{1, 4}, b.Stats().NumNodes())
+}
+
+func TestBitsetLeafKindsOps(t *testing.T) {
+
+	// kinds fills the leaf at base with bits that make it a leaf of the kind
+	kinds := []func(b Bitset, base, seed uint64) node{
+		func(b Bitset, base, seed uint64) node {
+			b.Set(base + seed).Set(base + 63).Set(base + 64 + seed).Set(base + 100).Set(base + 1<<12 - 1)
+			return &arrayleaf{}
+		},
+		func(b Bitset, base, seed uint64) node {
+			b.SetRange(base+10*seed, base+1000).SetRange(base+2000+seed, base+1<<12-1)
+			return &runleaf{}
+		},
+		func(b Bitset, base, seed uint64) node {
+			for i := base + seed; i < base+1<<12; i += 3 + seed {
+				b.Set(i)
+			}
+			return &leaf{}
+		},
+	}
+
+	// every kind of leaf in 'a' against every kind in 'b', in turn
+	a, b := New([]uint{12, 4}), New([]uint{12, 4})
+	refA, refB := New([]uint{6, 6, 4}), New([]uint{6, 6, 4}) // bitmap leaves only
+
+	for i, base := 0, uint64(0); i < 9; i, base = i+1, base+1<<12 {
+
+		assert.IsType(t, kinds[i/3](a, base, 1), a.(*bitset).root.(*inode).nodes[i])
+		assert.IsType(t, kinds[i%3](b, base, 2), b.(*bitset).root.(*inode).nodes[i])
+
+		kinds[i/3](refA, base, 1)
+		kinds[i%3](refB, base, 2)
+	}
+
+	for _, f := range []struct {
+		op    func(a, b Bitset) (Bitset, error)
+		count func(a, b Bitset) (uint64, error)
+	}{
+		{Bitset.And, Bitset.IntersectionCount},
+		{Bitset.Or, Bitset.UnionCount},
+		{Bitset.Xor, Bitset.XorCount},
+		{Bitset.AndNot, Bitset.DifferenceCount},
+	} {
+		want, _ := f.op(refA, refB)
+
+		got, err := f.op(a, b)
+		assert.NoError(t, err)
+		assert.NoError(t, got.Validate())
+		assert.EqualValues(t, want.Count(), got.Count())
+		assert.EqualValues(t, slices.Collect(want.SetBits()), slices.Collect(got.SetBits()))
+
+		count, err := f.count(a, b)
+		assert.NoError(t, err)
+		assert.EqualValues(t, want.Count(), count)
+
+		// counting doesn't allocate, whatever the kinds of leaves
+		assert.Zero(t, testing.AllocsPerRun(10, func() { f.count(a, b) }))
+	}
+}
+
+func TestBitsetStats(t *testing.T) {
+
+	b := New([]uint{8, 4})
+
+	b.Set(3)                      // array leaf
+	b.SetRange(1<<8, 2<<8-1)      // setnode
+	b.SetRange(2<<8+10, 2<<8+209) // run leaf
+
+	// bitmap leaf, half full
+	for i := uint64(3 << 8); i < 4<<8; i += 2 {
+		b.Set(i)
+	}
+
+	s := b.Stats()
+
+	assert.EqualValues(t, []int{1, 3}, s.NumNodes())
+	assert.EqualValues(t, []uint{4, 8}, []uint{s.Levels[0].Bits, s.Levels[1].Bits})
+
+	root, leaves := s.Levels[0], s.Levels[1]
+	assert.EqualValues(t, 1, root.Inodes)
+	assert.EqualValues(t, inodeBytes+16*childBytes, root.Bytes)
+
+	assert.EqualValues(t, 3, leaves.Leaves)
+	assert.EqualValues(t, 1, leaves.ArrayLeaves)
+	assert.EqualValues(t, 1, leaves.RunLeaves)
+	assert.EqualValues(t, 1, leaves.SetNodes)
+	assert.EqualValues(t, 12, leaves.ClrNodes)
+	assert.EqualValues(t, [10]int{0: 1, 5: 1, 7: 1}, leaves.Fill)
+
+	assert.EqualValues(t, root.Bytes+leaves.Bytes, s.Bytes)
+	assert.EqualValues(t, 1<<12/8, s.FlatBytes)
+	assert.InDelta(t, s.FlatBytes/s.Bytes, s.Compression, 1e-9)
+
+	// nothing materialized
+	b.SetAll()
+	s = b.Stats()
+
+	assert.EqualValues(t, []int{0, 0}, s.NumNodes())
+	assert.EqualValues(t, 1, s.Levels[0].SetNodes)
+	assert.True(t, math.IsInf(s.Compression, 1))
+}
+
+func TestBitsetValidate(t *testing.T) {
+
+	for _, cfg := range append(configs, []uint{8, 4}, []uint{10, 2, 2}) {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			r := rand.New(rand.NewSource(1))
+
+			b := New(cfg)
+			max := b.Max()
+
+			assert.NoError(t, b.Validate())
+
+			for i := 0; i < 500; i++ {
+
+				idx, end := uint64(r.Int63n(int64(max)+1)), uint64(r.Int63n(int64(max)+1))
+
+				if idx > end {
+					idx, end = end, idx
+				}
+
+				switch r.Intn(9) {
+				case 0:
+					b.Set(idx)
+
+				case 1:
+					b.Clear(idx)
+
+				case 2:
+					b.Flip(idx)
+
+				case 3:
+					b.Swap(idx, r.Intn(2) == 0)
+
+				case 4:
+					b.SetRange(idx, end)
+
+				case 5:
+					b.ClearRange(idx, end)
+
+				case 6:
+					b.FlipRange(idx, end)
+
+				case 7:
+					c := b.Clone().FlipRange(idx, end)
+					assert.NoError(t, c.Validate())
+					assert.NoError(t, b.InPlaceXor(c))
+
+				case 8:
+					c := New(cfg).SetRange(idx, end)
+					assert.NoError(t, b.InPlaceOr(c))
+				}
+
+				if err := b.Validate(); err != nil {
+					assert.NoError(t, err, "op %d", i)
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestBitsetValidateCorrupt(t *testing.T) {
+
+	corrupt := func(f func(b *bitset)) error {
+
+		b := New([]uint{8, 4}).(*bitset)
+
+		b.Set(3)                      // array leaf
+		b.SetRange(2<<8+10, 2<<8+209) // run leaf
+
+		// bitmap leaf
+		for i := uint64(3 << 8); i < 4<<8; i += 2 {
+			b.Set(i)
+		}
+
+		f(b)
+
+		return b.Validate()
+	}
+
+	nodes := func(b *bitset) []node {
+		return b.root.(*inode).nodes
+	}
+
+	assert.NoError(t, corrupt(func(b *bitset) {}))
+
+	for name, f := range map[string]func(b *bitset){
+		"count":        func(b *bitset) { b.count++ },
+		"numNodes":     func(b *bitset) { b.rootLevel.next.numNodes++ },
+		"inode nSet":   func(b *bitset) { b.root.(*inode).nSet++ },
+		"inode numSet": func(b *bitset) { b.root.(*inode).numSet++ },
+		"leaf numSet":  func(b *bitset) { nodes(b)[3].(*leaf).numSet++ },
+		"leaf full": func(b *bitset) {
+			l, ll := nodes(b)[3].(*leaf), b.rootLevel.next
+			b.count += uint64(ll.total - l.numSet)
+			b.root.(*inode).numSet += uint64(ll.total - l.numSet)
+			l.bits, l.numSet = newLeafSet(ll).bits, ll.total
+		},
+		"array order": func(b *bitset) {
+			a := nodes(b)[0].(*arrayleaf)
+			a.offsets = append(a.offsets, 2)
+			b.count++
+			b.root.(*inode).numSet++
+		},
+		"run adjacent": func(b *bitset) {
+			r := nodes(b)[2].(*runleaf)
+			r.runs = append(r.runs, run{r.runs[0].last + 1, r.runs[0].last + 1})
+			r.numSet++
+			b.count++
+			b.root.(*inode).numSet++
+		},
+		"inode sparse": func(b *bitset) {
+			in, l := b.root.(*inode), b.rootLevel
+			for i := range in.nodes {
+				delNode(l.next, in.nodes[i])
+				in.nodes[i] = newSparseClr(l.next)
+			}
+			in.nSet, in.nClr, in.numSet, b.count = 0, l.total, 0, 0
+		},
+	} {
+		err := corrupt(f)
+		assert.ErrorIs(t, err, ErrInvalid, name)
+	}
+}
+
+func TestBitsetDump(t *testing.T) {
+
+	b := New([]uint{8, 4})
+
+	b.Set(3)
+	b.SetRange(1<<8, 3<<8-1)
+	b.SetRange(3<<8+10, 3<<8+209)
+
+	var buf bytes.Buffer
+
+	assert.NoError(t, b.Dump(&buf, DumpText))
+	assert.Equal(t, `[0, 4095] inode set=713 (16 children: 2 set, 12 clr)
+  [0, 255] arrayleaf set=1
+  [256, 767] setnode x2 set=512
+  [768, 1023] runleaf set=200 (1 runs)
+  [1024, 4095] clrnode x12 set=0
+`, buf.String())
+
+	buf.Reset()
+
+	assert.NoError(t, b.Dump(&buf, DumpDot))
+	assert.Equal(t, `digraph bitset {
+	node [shape=box, fontname=monospace];
+	n0 [label="[0, 4095]\ninode set=713 (16 children: 2 set, 12 clr)"];
+	n1 [label="[0, 255]\narrayleaf set=1"];
+	n0 -> n1;
+	n2 [label="[256, 767]\nsetnode x2 set=512", style=dashed];
+	n0 -> n2;
+	n3 [label="[768, 1023]\nrunleaf set=200 (1 runs)"];
+	n0 -> n3;
+	n4 [label="[1024, 4095]\nclrnode x12 set=0", style=dashed];
+	n0 -> n4;
+}
+`, buf.String())
+
+	// the same, through a concurrent bitset
+	c, err := NewConcurrent([]uint{8, 4})
+	assert.NoError(t, err)
+	assert.NoError(t, c.InPlaceOr(b))
+
+	var cbuf bytes.Buffer
+
+	assert.NoError(t, c.Dump(&cbuf, DumpDot))
+	assert.Equal(t, buf.String(), cbuf.String())
+
+	assert.Error(t, b.Dump(&buf, DumpFormat(-1)))
+
+	// a sparse root
+	buf.Reset()
+
+	assert.NoError(t, New([]uint{8, 4}).Dump(&buf, DumpText))
+	assert.Equal(t, "[0, 4095] clrnode set=0\n", buf.String())
+
+	// a full 64-bit root, whose count doesn't fit a uint64
+	buf.Reset()
+
+	assert.NoError(t, New([]uint{16, 16, 16, 16}).SetAll().Dump(&buf, DumpText))
+	assert.Equal(t, "[0, 18446744073709551615] setnode set=18446744073709551616\n", buf.String())
+}
+
+func TestBitsetFromSorted(t *testing.T) {
+
+	for _, cfg := range append(configs, []uint{8, 4}, []uint{10, 2, 2}, []uint{8, 8, 8, 8, 8, 8, 8, 8}) {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			r := rand.New(rand.NewSource(1))
+
+			ref := New(cfg)
+			max := ref.Max()
+
+			// sparse bits, dense runs and full subtrees
+			var idxs []uint64
+
+			for idx := uint64(r.Int63n(8)); len(idxs) < 20000; {
+
+				idxs = append(idxs, idx)
+
+				step := uint64(1)
+
+				switch r.Intn(4) {
+				case 0:
+					idxs = append(idxs, idx) // repeated
+					step += r.Uint64() % (max/64 + 1)
+
+				case 1:
+					step += uint64(r.Intn(4))
+				}
+
+				if step > max-idx {
+					break
+				}
+
+				idx += step
+			}
+
+			for _, idx := range idxs {
+				ref.Set(idx)
+			}
+
+			bs, err := FromSorted(cfg, idxs)
+			assert.NoError(t, err)
+
+			bq, err := FromSeq(cfg, ref.SetBits())
+			assert.NoError(t, err)
+
+			for _, b := range []Bitset{bs, bq} {
+
+				assert.NoError(t, b.Validate())
+				assert.EqualValues(t, ref.Count(), b.Count())
+
+				n, err := b.XorCount(ref)
+				assert.NoError(t, err)
+				assert.EqualValues(t, 0, n)
+
+				// and it's a normal bitset
+				b.Flip(max / 2).Flip(0)
+				assert.NoError(t, b.Validate())
+			}
+
+			// empty, and full
+			b, err := FromSorted(cfg, nil)
+			assert.NoError(t, err)
+			assert.True(t, b.None())
+			assert.NoError(t, b.Validate())
+
+			if max < 1<<16 {
+
+				b, err = FromSeq(cfg, New(cfg).SetAll().SetBits())
+				assert.NoError(t, err)
+				assert.True(t, b.All())
+				assert.EqualValues(t, []int(make([]int, len(cfg))), b.Stats().NumNodes())
+				assert.NoError(t, b.Validate())
+			}
+		})
+	}
+}
+
+func TestBuilder(t *testing.T) {
+
+	b, err := NewBuilder([]uint{8, 4})
+	assert.NoError(t, err)
+
+	assert.NoError(t, b.Add(10))
+	assert.NoError(t, b.Add(10))
+	assert.NoError(t, b.AddWord(64, 0xf0))
+	assert.Equal(t, ErrNotSorted, b.Add(9))
+	assert.Equal(t, ErrNotSorted, b.AddWord(0, 1<<11))
+	assert.Equal(t, ErrUnaligned, b.AddWord(130, 1))
+	assert.Equal(t, ErrOutOfRange, b.Add(1<<12))
+
+	x := b.Bitset()
+	assert.EqualValues(t, 5, x.Count())
+	assert.NoError(t, x.Validate())
+
+	// the builder is reset, and builds independent bitsets
+	assert.NoError(t, b.Add(3))
+
+	y := b.Bitset()
+	assert.EqualValues(t, 1, y.Count())
+	assert.True(t, x.Test(10) && !y.Test(10))
+	assert.NoError(t, y.Validate())
+
+	_, err = FromSorted([]uint{8, 4}, []uint64{5, 4})
+	assert.Equal(t, ErrNotSorted, err)
+
+	_, err = FromSorted(nil, nil)
+	assert.Equal(t, ErrEmptyLayout, err)
+}
+
+func TestBitsetMany(t *testing.T) {
+
+	news := map[string]func(levelBits []uint) (Bitset, error){"bitset": NewWithError}
+
+	for name, f := range concurrentNews {
+		news[name] = f
+	}
+
+	for name, newBitset := range news {
+		for _, cfg := range append(configs, []uint{8, 4}, []uint{8, 8, 8, 8, 8, 8, 8, 8}) {
+			t.Run(fmt.Sprintf("%s/%v", name, cfg), func(t *testing.T) {
+
+				r := rand.New(rand.NewSource(1))
+
+				b, err := newBitset(cfg)
+				assert.NoError(t, err)
+
+				ref := New(cfg)
+				max := ref.Max()
+
+				// clustered indexes, in any order, with repeats and some
+				// beyond max
+				idxs := func(n int) []uint64 {
+
+					idxs := make([]uint64, n)
+					base := r.Uint64() & max
+
+					for i := range idxs {
+
+						switch r.Intn(8) {
+						case 0:
+							idxs[i] = r.Uint64() & max
+
+						case 1:
+							idxs[i] = max + 1 + uint64(r.Intn(8)) // may wrap around to 0
+							base = r.Uint64() & max
+
+						default:
+							idxs[i] = (base + uint64(r.Intn(300))) & max
+						}
+					}
+
+					if r.Intn(2) == 0 {
+						slices.Sort(idxs)
+					}
+
+					return idxs
+				}
+
+				for round := 0; round < 20; round++ {
+
+					x := idxs(r.Intn(1000))
+					before := slices.Clone(x)
+
+					var changed, want uint64
+
+					if round%3 == 2 {
+
+						changed = b.ClearMany(x)
+
+						for _, idx := range x {
+							if ref.Test(idx) {
+								want++
+								ref.Clear(idx)
+							}
+						}
+					} else {
+
+						changed = b.SetMany(x)
+
+						for _, idx := range x {
+							if idx <= max && !ref.Test(idx) {
+								want++
+								ref.Set(idx)
+							}
+						}
+					}
+
+					assert.EqualValues(t, want, changed)
+					assert.EqualValues(t, before, x, "indexes modified")
+					assert.EqualValues(t, ref.Count(), b.Count())
+					assert.NoError(t, b.Validate())
+
+					n, err := b.XorCount(ref)
+					assert.NoError(t, err)
+					assert.EqualValues(t, 0, n)
+
+					x = idxs(r.Intn(1000))
+					out := make([]bool, len(x))
+
+					b.TestMany(x, out)
+
+					for i, idx := range x {
+						if out[i] != ref.Test(idx) {
+							assert.Fail(t, "TestMany", "%d", idx)
+							return
+						}
+					}
+				}
+
+				// on a clone, leaving the original as it was
+				c := b.Clone()
+				x := idxs(1000)
+
+				c.SetMany(x)
+				c.ClearMany(x[:500])
+
+				n, err := b.XorCount(ref)
+				assert.NoError(t, err)
+				assert.EqualValues(t, 0, n)
+				assert.NoError(t, b.Validate())
+				assert.NoError(t, c.Validate())
+
+				// filling and emptying whole subtrees
+				all := make([]uint64, min(max, 1<<14)+1)
+
+				for i := range all {
+					all[i] = uint64(i)
+				}
+
+				c.SetMany(all)
+				assert.EqualValues(t, len(all), c.CountRange(0, uint64(len(all)-1)))
+				assert.NoError(t, c.Validate())
+
+				c.ClearMany(all)
+				assert.EqualValues(t, 0, c.CountRange(0, uint64(len(all)-1)))
+				assert.NoError(t, c.Validate())
+			})
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package bitset
+
+import (
+	"errors"
+	"iter"
+	"math/bits"
+)
+
+type (
+	// Builder builds a bitset bottom-up from indexes added in ascending
+	// order: only the nodes on the path to the last index are open, and each
+	// node is packed (or sparsified) once, as the indexes move past it,
+	// rather than being materialized and re-packed with every bit set.
+	Builder struct {
+		rootLevel *level
+		levels    []*level // by height (leaf level first)
+		max       uint64
+
+		leaf   *leaf    // open leaf, if any
+		lo, hi int      // words of the open leaf with bits set
+		spare  *leaf    // bitmap of a closed leaf that was packed, for reuse
+		path   []*inode // open inodes, by height (nil if none)
+		bases  []uint64 // base index of the open nodes, by height
+
+		count   uint64
+		last    uint64
+		started bool
+	}
+)
+
+var (
+	// ErrNotSorted is returned when indexes are added to a Builder out of order
+	ErrNotSorted = errors.New("bitset: indexes not in ascending order")
+
+	// ErrUnaligned is returned when a word is added to a Builder at a base
+	// that isn't a multiple of 64
+	ErrUnaligned = errors.New("bitset: word base not a multiple of 64")
+)
+
+// NewBuilder returns a Builder of a bitset with the given level layout
+func NewBuilder(levelBits []uint) (*Builder, error) {
+
+	rootLevel, max, err := initLevels(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Builder{
+		levels: make([]*level, len(levelBits)),
+		path:   make([]*inode, len(levelBits)),
+		bases:  make([]uint64, len(levelBits)),
+	}
+
+	b.init(rootLevel, max)
+
+	return b, nil
+}
+
+func (b *Builder) init(rootLevel *level, max uint64) {
+
+	b.rootLevel, b.max = rootLevel, max
+
+	for l := rootLevel; l != nil; l = l.next {
+		b.levels[l.height] = l
+	}
+
+	b.count, b.last, b.started = 0, 0, false
+}
+
+// reset readies the builder for another bitset, with new levels (so the
+// nodes are not shared with the bitset built)
+func (b *Builder) reset() {
+
+	rootLevel, max, _ := initLevels(b.levelBits())
+	b.init(rootLevel, max)
+}
+
+func (b *Builder) levelBits() []uint {
+
+	levelBits := make([]uint, len(b.levels))
+
+	for h, l := range b.levels {
+		levelBits[h] = l.bits
+	}
+
+	return levelBits
+}
+
+// FromSorted returns a bitset with the given level layout, and the bits at
+// the given indexes set; the indexes must be in ascending order (repeated
+// indexes are fine)
+func FromSorted(levelBits []uint, idxs []uint64) (Bitset, error) {
+
+	b, err := NewBuilder(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// leaves of a word or more are filled a word at a time
+	words := b.levels[0].total >= 64
+
+	for i := 0; i < len(idxs); {
+
+		if !words {
+
+			if err := b.Add(idxs[i]); err != nil {
+				return nil, err
+			}
+
+			i++
+			continue
+		}
+
+		// gather the indexes in the same word
+		w, mask := idxs[i]/64, uint64(0)
+
+		for ; i < len(idxs) && idxs[i]/64 == w; i++ {
+
+			if i > 0 && idxs[i] < idxs[i-1] {
+				return nil, ErrNotSorted
+			}
+
+			mask |= 1 << (idxs[i] % 64)
+		}
+
+		if err := b.AddWord(w*64, mask); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Bitset(), nil
+}
+
+// FromSeq is FromSorted, for indexes from an ascending sequence
+func FromSeq(levelBits []uint, seq iter.Seq[uint64]) (Bitset, error) {
+
+	b, err := NewBuilder(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range seq {
+
+		if err := b.Add(idx); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Bitset(), nil
+}
+
+// Add sets the bit at idx, which must not be below the indexes added before
+func (b *Builder) Add(idx uint64) error {
+	return b.AddWord(idx&^63, 1<<(idx%64))
+}
+
+// AddWord sets the bits of the word at base (a multiple of 64) given by
+// mask, all of which must not be below the indexes added before; with
+// leaves of fewer than 64 bits, the word is added a bit at a time
+func (b *Builder) AddWord(base, mask uint64) error {
+
+	if base%64 != 0 {
+		return ErrUnaligned
+	}
+
+	if mask == 0 {
+		return nil
+	}
+
+	first := base + uint64(bits.TrailingZeros64(mask))
+	last := base + 63 - uint64(bits.LeadingZeros64(mask))
+
+	if b.started && first < b.last {
+		return ErrNotSorted
+	}
+
+	if last > b.max {
+		return ErrOutOfRange
+	}
+
+	// drop the bit added last, if it's added again
+	if b.started && first == b.last {
+
+		if mask &= mask - 1; mask == 0 {
+			return nil
+		}
+	}
+
+	if b.levels[0].total < 64 {
+
+		for ; mask != 0; mask &= mask - 1 {
+
+			idx := base + uint64(bits.TrailingZeros64(mask))
+
+			b.open(idx)
+			b.setBits(idx, 1)
+		}
+	} else {
+		b.open(base)
+		b.setBits(base, mask)
+	}
+
+	b.last, b.started = last, true
+
+	return nil
+}
+
+// setBits sets the bits of mask in the open leaf, at the (word aligned, or
+// single bit) index idx
+func (b *Builder) setBits(idx, mask uint64) {
+
+	i := idx - b.bases[0]
+
+	if b.levels[0].total < 64 {
+		mask <<= i % 64
+	}
+
+	w := int(i / 64)
+
+	if b.leaf.numSet == 0 {
+		b.lo = w
+	}
+
+	b.leaf.bits[w] |= mask
+	b.leaf.numSet += bits.OnesCount64(mask)
+	b.hi = w
+}
+
+// open closes the open nodes that don't cover idx, and opens the nodes on
+// the path to it
+func (b *Builder) open(idx uint64) {
+
+	// close bottom-up, up to the first open node covering idx
+	for h, l := range b.levels {
+
+		if !b.isOpen(h) {
+			continue
+		}
+
+		if idx-b.bases[h] <= l.max && idx >= b.bases[h] {
+			break
+		}
+
+		b.close(h)
+	}
+
+	// open top-down
+	for h := len(b.levels) - 1; h >= 0; h-- {
+
+		if b.isOpen(h) {
+			continue
+		}
+
+		l := b.levels[h]
+		b.bases[h] = idx &^ l.max
+
+		if l.leaf {
+			b.leaf = b.newLeaf(l)
+		} else {
+			b.path[h] = newNode(l, false, false).(*inode)
+		}
+	}
+}
+
+// newLeaf returns a new all-clr bitmap leaf, reusing the spare one if any
+func (b *Builder) newLeaf(l *level) *leaf {
+
+	n := b.spare
+
+	if n == nil {
+		return newBitmap(l)
+	}
+
+	b.spare = nil
+	l.numNodes++ // #stats
+
+	n.owner, n.numSet = l.token(), 0
+
+	return n
+}
+
+func (b *Builder) isOpen(h int) bool {
+
+	if h == 0 {
+		return b.leaf != nil
+	}
+
+	return b.path[h] != nil
+}
+
+// close packs (or compacts) the open node at height h, and places it in its
+// parent (or counts it, as the root), returning it
+func (b *Builder) close(h int) (n node) {
+
+	l := b.levels[h]
+
+	var set uint64
+
+	if h == 0 {
+		set = uint64(b.leaf.numSet)
+
+		// the bitmap is no longer used, if the leaf was packed into another
+		// kind of node
+		if n = packWords(l, b.leaf, b.lo, b.hi); n != node(b.leaf) {
+			clear(b.leaf.bits[b.lo : b.hi+1])
+			b.spare = b.leaf
+		}
+
+		b.leaf = nil
+	} else {
+		set = b.path[h].numSet
+		n, b.path[h] = b.path[h].compact(l), nil
+	}
+
+	// the root has no parent
+	if h+1 < len(b.levels) {
+
+		parent := b.path[h+1]
+
+		parent.replace(int((b.bases[h]-b.bases[h+1])>>b.levels[h+1].shift), n)
+		parent.numSet += set
+	} else {
+		b.count = set
+	}
+
+	return n
+}
+
+// Bitset closes all the open nodes, and returns the bitset built; the
+// Builder is reset, to build another
+func (b *Builder) Bitset() Bitset {
+
+	var root node
+
+	if b.started {
+		for h := range b.levels {
+			root = b.close(h)
+		}
+	} else {
+		root = newNode(b.rootLevel, true, false)
+	}
+
+	t := &bitset{
+		root:      root,
+		rootLevel: b.rootLevel,
+		count:     b.count,
+		max:       b.max,
+	}
+
+	t.debugValidate()
+
+	b.reset()
+
+	return t
+}
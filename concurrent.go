@@ -0,0 +1,1087 @@
+package bitset
+
+import (
+	"io"
+	"iter"
+	"math"
+	"math/bits"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// concurrent is a Bitset that is safe for use by multiple goroutines; the
+	// tree is striped by the children of the root inode, with each stripe (a
+	// bitset of the levels under the root) guarded by its own lock, so that
+	// writers to different regions of the index space do not block each other
+	concurrent struct {
+		stripes   []stripe
+		levelBits []uint // layout of the whole bitset
+		single    bool   // single (leaf) level, with one stripe for it all
+		lockFree  bool   // lock-free updates to leaf words (see NewAtomic)
+		shift     uint   // idx>>shift is the stripe
+		mask      uint64 // idx&mask is the index within the stripe
+		max       uint64
+		count     uint64 // sum of stripe counts (atomic)
+	}
+
+	stripe struct {
+		sync.RWMutex
+		b *bitset
+	}
+)
+
+// NewConcurrent returns a new bitset with the given level layout, that can
+// be used concurrently; each child of the root level gets its own lock (and
+// a bitset of the levels under it), so a wider root level allows for more
+// concurrency, at the cost of more memory.
+func NewConcurrent(levelBits []uint) (Bitset, error) {
+
+	t, err := newConcurrent(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func newConcurrent(levelBits []uint) (*concurrent, error) {
+
+	rootLevel, max, err := initLevels(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &concurrent{
+		levelBits: append([]uint(nil), levelBits...),
+		max:       max,
+	}
+
+	stripeBits := levelBits[:len(levelBits)-1]
+
+	if rootLevel.leaf {
+		// a single (leaf) level can't be striped
+		t.stripes, stripeBits = make([]stripe, 1), levelBits
+		t.shift, t.mask, t.single = 64, math.MaxUint64, true
+	} else {
+		t.stripes = make([]stripe, rootLevel.total)
+		t.shift, t.mask = rootLevel.shift, rootLevel.mask
+	}
+
+	for i := range t.stripes {
+		b, _ := NewWithError(stripeBits)
+		t.stripes[i].b = b.(*bitset)
+	}
+
+	return t, nil
+}
+
+// locate returns the stripe holding the index, and the index within it
+func (t *concurrent) locate(idx uint64) (s *stripe, i uint64) {
+	return &t.stripes[idx>>t.shift], idx & t.mask
+}
+
+// update runs the (write) op on the stripe, under its lock, and applies the
+// change in the stripe's count to the total count
+func (t *concurrent) update(s *stripe, op func(b *bitset)) {
+
+	s.Lock()
+
+	count := s.b.count
+	op(s.b)
+	delta := s.b.count - count
+
+	s.Unlock()
+
+	atomic.AddUint64(&t.count, delta)
+}
+
+// rlock acquires the lock on the stripe for reading the tree; in lock-free
+// mode, leaf words are modified under the read lock, so the scans (which read
+// them non-atomically) need the exclusive lock
+func (t *concurrent) rlock(s *stripe) {
+
+	if t.lockFree {
+		s.Lock()
+	} else {
+		s.RLock()
+	}
+}
+
+func (t *concurrent) runlock(s *stripe) {
+
+	if t.lockFree {
+		s.Unlock()
+	} else {
+		s.RUnlock()
+	}
+}
+
+// lockAll acquires the locks on all stripes (always in the same order)
+func (t *concurrent) lockAll() {
+
+	for i := range t.stripes {
+		t.stripes[i].Lock()
+	}
+}
+
+func (t *concurrent) unlockAll() {
+
+	for i := range t.stripes {
+		t.stripes[i].Unlock()
+	}
+}
+
+// rlockAll acquires the locks on all stripes for reading (see rlock), in the
+// same order as lockAll
+func (t *concurrent) rlockAll() {
+
+	for i := range t.stripes {
+		t.rlock(&t.stripes[i])
+	}
+}
+
+func (t *concurrent) runlockAll() {
+
+	for i := range t.stripes {
+		t.runlock(&t.stripes[i])
+	}
+}
+
+// snapshot returns a *bitset with the current contents of all the stripes,
+// taken under their read locks; the nodes are shared with the stripes (see
+// level.share), so this is cheap, and the snapshot remains valid (and can be
+// modified) after the locks are released
+func (t *concurrent) snapshot() *bitset {
+
+	t.rlockAll()
+	defer t.runlockAll()
+
+	for i := range t.stripes {
+		t.stripes[i].b.rootLevel.share()
+	}
+
+	return t.view()
+}
+
+// view returns a *bitset over the current contents of all the stripes, which
+// must be locked (at least for reading); the stripes are not modified, and
+// the view owns none of their nodes (so modifying it copies them), but it's
+// only valid until the locks are released, as the stripes may then modify
+// their nodes in place (see snapshot)
+func (t *concurrent) view() *bitset {
+
+	if t.single {
+
+		b := t.stripes[0].b
+
+		return &bitset{
+			root:      b.root,
+			rootLevel: cloneLevels(b.rootLevel),
+			count:     b.count,
+			max:       b.max,
+		}
+	}
+
+	rootLevel, max, _ := initLevels(t.levelBits)
+
+	root := newNode(rootLevel, false, false).(*inode)
+
+	var count uint64
+
+	for i := range t.stripes {
+
+		b := t.stripes[i].b
+
+		root.replace(i, b.root)
+		addNode(rootLevel.next, b.root) // #stats
+		count += b.count
+	}
+
+	root.numSet = count
+
+	return &bitset{
+		root:      root.compact(rootLevel),
+		rootLevel: rootLevel,
+		count:     count,
+		max:       max,
+	}
+}
+
+// load replaces the contents of the stripes with that of b (which must have
+// the same layout); must be called with all stripes locked
+func (t *concurrent) load(b *bitset) {
+
+	var count uint64
+
+	for i := range t.stripes {
+
+		s := &t.stripes[i]
+
+		root := b.root
+
+		if !t.single {
+
+			// sparse nodes are the same at every level
+			if in, ok := b.root.(*inode); ok {
+				root = in.nodes[i]
+			}
+		}
+
+		rootLevel := cloneLevels(s.b.rootLevel)
+
+		// reset the #stats for the new tree
+		for l := rootLevel; l != nil; l = l.next {
+			l.numNodes = 0
+		}
+
+		addNode(rootLevel, root)
+
+		s.b = &bitset{
+			root:      root,
+			rootLevel: rootLevel,
+			count:     root.count(rootLevel),
+			max:       s.b.max,
+		}
+
+		count += s.b.count
+	}
+
+	atomic.StoreUint64(&t.count, count)
+}
+
+// fromBitset returns a concurrent bitset with the contents of b
+func fromBitset(b *bitset) *concurrent {
+
+	t, _ := newConcurrent(b.levelBits())
+
+	t.lockAll()
+	t.load(b)
+	t.unlockAll()
+
+	return t
+}
+
+func (t *concurrent) Max() uint64 {
+	return t.max
+}
+
+func (t *concurrent) Cap() uint64 {
+
+	if t.max == math.MaxUint64 {
+		return math.MaxUint64
+	}
+
+	return t.max + 1
+}
+
+func (t *concurrent) Cap128() (hi, lo uint64) {
+
+	lo, hi = bits.Add64(t.max, 1, 0)
+	return hi, lo
+}
+
+func (t *concurrent) Count() uint64 {
+
+	if hi, _ := t.Count128(); hi != 0 {
+		return math.MaxUint64
+	}
+
+	return atomic.LoadUint64(&t.count)
+}
+
+func (t *concurrent) CountRange(start, end uint64) (set uint64) {
+
+	if end > t.max {
+		end = t.max
+	}
+
+	switch {
+	case start > end:
+		return 0
+
+	case start == 0 && end == t.max:
+		return t.Count()
+	}
+
+	first, last := start>>t.shift, end>>t.shift
+
+	for i := first; i <= last; i++ {
+
+		lo, hi := uint64(0), t.mask
+
+		if i == first {
+			lo = start & t.mask
+		}
+
+		if i == last {
+			hi = end & t.mask
+		}
+
+		s := &t.stripes[i]
+
+		t.rlock(s)
+		set += s.b.CountRange(lo, hi)
+		t.runlock(s)
+	}
+
+	return set
+}
+
+func (t *concurrent) Rank(idx uint64) uint64 {
+	return t.CountRange(0, idx)
+}
+
+// Select looks for the stripe holding the n-th set bit by the stripe counts
+func (t *concurrent) Select(n uint64) (idx uint64, found bool) {
+
+	for i := range t.stripes {
+
+		s := &t.stripes[i]
+
+		t.rlock(s)
+		idx, found = s.b.Select(n)
+		c := s.b.count
+		t.runlock(s)
+
+		if found {
+			return (uint64(i) << t.shift) | idx, true
+		}
+
+		n -= c
+	}
+
+	return math.MaxUint64, false
+}
+
+func (t *concurrent) Count128() (hi, lo uint64) {
+
+	// the count wraps to 0 only when all 2^64 bits are set
+	if count := atomic.LoadUint64(&t.count); count != 0 || !t.All() {
+		return 0, count
+	}
+
+	return 1, 0
+}
+
+func (t *concurrent) Test(idx uint64) bool {
+
+	if idx > t.max {
+		return false
+	}
+
+	s, i := t.locate(idx)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if t.lockFree {
+		return s.b.testAtomic(i)
+	}
+
+	return s.b.Test(i)
+}
+
+func (t *concurrent) Set(idx uint64) Bitset {
+
+	if idx > t.max {
+		return nil
+	}
+
+	s, i := t.locate(idx)
+
+	if t.lockFree {
+
+		s.RLock()
+		set, ok := s.b.setAtomic(i)
+		s.RUnlock()
+
+		if set {
+			atomic.AddUint64(&t.count, 1)
+		}
+
+		if ok {
+			return t
+		}
+	}
+
+	t.update(s, func(b *bitset) { b.Set(i) })
+
+	return t
+}
+
+func (t *concurrent) Clear(idx uint64) Bitset {
+
+	if idx > t.max {
+		return nil
+	}
+
+	s, i := t.locate(idx)
+
+	if t.lockFree {
+
+		s.RLock()
+		cleared, ok := s.b.clrAtomic(i)
+		s.RUnlock()
+
+		if cleared {
+			atomic.AddUint64(&t.count, ^uint64(0)) // decrement
+		}
+
+		if ok {
+			return t
+		}
+	}
+
+	t.update(s, func(b *bitset) { b.Clear(i) })
+
+	return t
+}
+
+func (t *concurrent) Flip(idx uint64) Bitset {
+
+	if idx > t.max {
+		return t
+	}
+
+	s, i := t.locate(idx)
+	t.update(s, func(b *bitset) { b.Flip(i) })
+
+	return t
+}
+
+func (t *concurrent) TrySet(idx uint64) error {
+
+	if idx > t.max {
+		return ErrOutOfRange
+	}
+
+	t.Set(idx)
+
+	return nil
+}
+
+func (t *concurrent) TryClear(idx uint64) error {
+
+	if idx > t.max {
+		return ErrOutOfRange
+	}
+
+	t.Clear(idx)
+
+	return nil
+}
+
+func (t *concurrent) Swap(idx uint64, set bool) (swapped bool) {
+
+	if idx > t.max {
+		return false
+	}
+
+	s, i := t.locate(idx)
+	t.update(s, func(b *bitset) { swapped = b.Swap(i, set) })
+
+	return swapped
+}
+
+// SetMany sets the bits at the indexes (see bitset.SetMany), under the lock
+// of each stripe in turn
+func (t *concurrent) SetMany(idxs []uint64) (changed uint64) {
+	return t.many(idxs, true)
+}
+
+func (t *concurrent) ClearMany(idxs []uint64) (changed uint64) {
+	return t.many(idxs, false)
+}
+
+// many sets/clears the bits at the indexes, a stripe at a time
+func (t *concurrent) many(idxs []uint64, set bool) (changed uint64) {
+
+	// a copy, as byStripe modifies the indexes
+	idxs = slices.Clone(sortedIdxs(idxs, t.max))
+
+	t.byStripe(idxs, func(s *stripe, rel []uint64) {
+		t.update(s, func(b *bitset) { changed += b.many(rel, set) })
+	})
+
+	return changed
+}
+
+func (t *concurrent) TestMany(idxs []uint64, out []bool) {
+
+	out = out[:len(idxs)]
+
+	for i, idx := range idxs {
+
+		if idx > t.max {
+			out[i] = false
+		}
+	}
+
+	// test the stripes in order (with a copy of the indexes, as they are
+	// made relative to the stripe)
+	order := make([]int, len(idxs))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.Slice(order, func(a, b int) bool { return idxs[order[a]] < idxs[order[b]] })
+
+	sorted := make([]uint64, 0, len(idxs))
+
+	for _, o := range order {
+
+		if idxs[o] <= t.max {
+			sorted = append(sorted, idxs[o])
+		}
+	}
+
+	res := make([]bool, len(sorted))
+	done := 0
+
+	t.byStripe(sorted, func(s *stripe, rel []uint64) {
+
+		t.rlock(s)
+		s.b.TestMany(rel, res[done:done+len(rel)])
+		t.runlock(s)
+
+		done += len(rel)
+	})
+
+	// (the indexes beyond max are last in the order)
+	for i, r := range res {
+		out[order[i]] = r
+	}
+}
+
+// byStripe calls 'do' for each stripe holding some of the sorted indexes,
+// with those indexes made relative to the stripe (modifying idxs)
+func (t *concurrent) byStripe(idxs []uint64, do func(s *stripe, rel []uint64)) {
+
+	for len(idxs) > 0 {
+
+		first := idxs[0] >> t.shift
+
+		j := 0
+
+		for ; j < len(idxs) && idxs[j]>>t.shift == first; j++ {
+			idxs[j] &= t.mask
+		}
+
+		do(&t.stripes[first], idxs[:j])
+
+		idxs = idxs[j:]
+	}
+}
+
+// rangeop runs the (write) op on each stripe overlapping [start, end], with
+// the part of the range within the stripe
+func (t *concurrent) rangeop(start, end uint64, op func(b *bitset, start, end uint64)) Bitset {
+
+	if end > t.max {
+		end = t.max
+	}
+
+	if start > end {
+		return t
+	}
+
+	first, last := start>>t.shift, end>>t.shift
+
+	for i := first; i <= last; i++ {
+
+		lo, hi := uint64(0), t.mask
+
+		if i == first {
+			lo = start & t.mask
+		}
+
+		if i == last {
+			hi = end & t.mask
+		}
+
+		t.update(&t.stripes[i], func(b *bitset) { op(b, lo, hi) })
+	}
+
+	return t
+}
+
+func (t *concurrent) SetRange(start, end uint64) Bitset {
+	return t.rangeop(start, end, func(b *bitset, start, end uint64) { b.SetRange(start, end) })
+}
+
+func (t *concurrent) ClearRange(start, end uint64) Bitset {
+	return t.rangeop(start, end, func(b *bitset, start, end uint64) { b.ClearRange(start, end) })
+}
+
+func (t *concurrent) FlipRange(start, end uint64) Bitset {
+	return t.rangeop(start, end, func(b *bitset, start, end uint64) { b.FlipRange(start, end) })
+}
+
+func (t *concurrent) SetAll() Bitset {
+	return t.SetRange(0, t.max)
+}
+
+func (t *concurrent) ClearAll() Bitset {
+	return t.ClearRange(0, t.max)
+}
+
+// next searches the stripes, starting at the one holding 'start'
+func (t *concurrent) next(start uint64, search func(b *bitset, start uint64) (uint64, bool)) (idx uint64, found bool) {
+
+	if start > t.max {
+		return math.MaxUint64, false
+	}
+
+	for i := start >> t.shift; i < uint64(len(t.stripes)); i++ {
+
+		s := &t.stripes[i]
+
+		t.rlock(s)
+		idx, found = search(s.b, start&t.mask)
+		t.runlock(s)
+
+		if found {
+			return (i << t.shift) | idx, true
+		}
+
+		start = 0
+	}
+
+	return math.MaxUint64, false
+}
+
+// prev searches the stripes backwards, starting at the one holding 'start'
+func (t *concurrent) prev(start uint64, search func(b *bitset, start uint64) (uint64, bool)) (idx uint64, found bool) {
+
+	if start > t.max {
+		start = t.max
+	}
+
+	for i := int(start >> t.shift); i >= 0; i-- {
+
+		s := &t.stripes[i]
+
+		t.rlock(s)
+		idx, found = search(s.b, start&t.mask)
+		t.runlock(s)
+
+		if found {
+			return (uint64(i) << t.shift) | idx, true
+		}
+
+		start = math.MaxUint64
+	}
+
+	return 0, false
+}
+
+func (t *concurrent) NextSet(start uint64) (idx uint64, found bool) {
+	return t.next(start, (*bitset).NextSet)
+}
+
+func (t *concurrent) NextClear(start uint64) (idx uint64, found bool) {
+	return t.next(start, (*bitset).NextClear)
+}
+
+func (t *concurrent) PrevSet(start uint64) (idx uint64, found bool) {
+	return t.prev(start, (*bitset).PrevSet)
+}
+
+func (t *concurrent) PrevClear(start uint64) (idx uint64, found bool) {
+	return t.prev(start, (*bitset).PrevClear)
+}
+
+func (t *concurrent) Any() bool {
+	return !t.None()
+}
+
+func (t *concurrent) All() bool {
+	return t.every((*bitset).All)
+}
+
+func (t *concurrent) None() bool {
+	return t.every((*bitset).None)
+}
+
+// every returns true if the predicate holds for all stripes
+func (t *concurrent) every(pred func(b *bitset) bool) bool {
+
+	for i := range t.stripes {
+
+		s := &t.stripes[i]
+
+		t.rlock(s)
+		ok := pred(s.b)
+		t.runlock(s)
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// forEach calls 'do' for each index found by 'next' in [start, end]; no lock
+// is held while calling 'do', so it may modify the bitset
+func (t *concurrent) forEach(start, end uint64, next func(start uint64) (uint64, bool), do func(idx uint64) bool) Bitset {
+
+	if end > t.max {
+		end = t.max
+	}
+
+	for i := start; i <= end; i++ {
+
+		var found bool
+
+		if i, found = next(i); !found || i > end || !do(i) || i == end {
+			break
+		}
+	}
+
+	return t
+}
+
+func (t *concurrent) ForEachSet(do func(idx uint64) bool) Bitset {
+	return t.forEach(0, t.max, t.NextSet, do)
+}
+
+func (t *concurrent) ForEachClear(do func(idx uint64) bool) Bitset {
+	return t.forEach(0, t.max, t.NextClear, do)
+}
+
+func (t *concurrent) ForEachSetRange(start, end uint64, do func(idx uint64) bool) Bitset {
+	return t.forEach(start, end, t.NextSet, do)
+}
+
+func (t *concurrent) ForEachClearRange(start, end uint64, do func(idx uint64) bool) Bitset {
+	return t.forEach(start, end, t.NextClear, do)
+}
+
+// Iterator returns an iterator over a snapshot of t, so it's not affected
+// by (and does not block) concurrent updates
+func (t *concurrent) Iterator() *Iterator {
+	return t.snapshot().Iterator()
+}
+
+// SetBits, Backward and Ranges iterate over a snapshot of t, taken when the
+// iteration starts
+
+func (t *concurrent) SetBits() iter.Seq[uint64] {
+
+	return func(yield func(idx uint64) bool) {
+		t.snapshot().SetBits()(yield)
+	}
+}
+
+func (t *concurrent) Backward() iter.Seq[uint64] {
+
+	return func(yield func(idx uint64) bool) {
+		t.snapshot().Backward()(yield)
+	}
+}
+
+func (t *concurrent) Ranges() iter.Seq2[uint64, uint64] {
+
+	return func(yield func(start, end uint64) bool) {
+		t.snapshot().Ranges()(yield)
+	}
+}
+
+// applyCopy merges 'b' into a snapshot of t, returning it as a new
+// concurrent bitset
+func (t *concurrent) applyCopy(o op, b Bitset) (Bitset, error) {
+
+	c := t.snapshot()
+
+	if err := c.apply(o, b); err != nil {
+		return nil, err
+	}
+
+	return fromBitset(c), nil
+}
+
+// other returns a snapshot of 'b', to be merged into t (or nil, if it's t
+// itself); it's taken before locking t, since 'b' may be locked in turn
+func (t *concurrent) other(b Bitset) (*bitset, error) {
+
+	if b == Bitset(t) {
+		return nil, nil
+	}
+
+	s, ok := b.(snapshotter)
+
+	if !ok {
+		return nil, ErrLayoutMismatch
+	}
+
+	return s.snapshot(), nil
+}
+
+// apply merges 'b' into t, in place, with all stripes locked
+func (t *concurrent) apply(o op, b Bitset) error {
+
+	ob, err := t.other(b)
+
+	if err != nil {
+		return err
+	}
+
+	t.lockAll()
+	defer t.unlockAll()
+
+	c := t.view()
+
+	if ob == nil {
+		ob = c
+	}
+
+	if !sameLayout(c.rootLevel, ob.rootLevel) {
+		return ErrLayoutMismatch
+	}
+
+	c.mergeWith(o, ob)
+	t.load(c)
+
+	return nil
+}
+
+// applyCount counts the bits in the result of merging 'b' into t, over a
+// view of t under the read locks of the stripes
+func (t *concurrent) applyCount(o op, b Bitset) (uint64, error) {
+
+	ob, err := t.other(b)
+
+	if err != nil {
+		return 0, err
+	}
+
+	t.rlockAll()
+	defer t.runlockAll()
+
+	v := t.view()
+
+	if ob == nil {
+		ob = v
+	}
+
+	return v.applyCount(o, ob)
+}
+
+func (t *concurrent) And(b Bitset) (Bitset, error) {
+	return t.applyCopy(opAnd, b)
+}
+
+func (t *concurrent) Or(b Bitset) (Bitset, error) {
+	return t.applyCopy(opOr, b)
+}
+
+func (t *concurrent) Xor(b Bitset) (Bitset, error) {
+	return t.applyCopy(opXor, b)
+}
+
+func (t *concurrent) AndNot(b Bitset) (Bitset, error) {
+	return t.applyCopy(opAndNot, b)
+}
+
+func (t *concurrent) Not() Bitset {
+	return fromBitset(t.snapshot().Not().(*bitset))
+}
+
+func (t *concurrent) InPlaceAnd(b Bitset) error {
+	return t.apply(opAnd, b)
+}
+
+func (t *concurrent) InPlaceOr(b Bitset) error {
+	return t.apply(opOr, b)
+}
+
+func (t *concurrent) InPlaceXor(b Bitset) error {
+	return t.apply(opXor, b)
+}
+
+func (t *concurrent) InPlaceAndNot(b Bitset) error {
+	return t.apply(opAndNot, b)
+}
+
+func (t *concurrent) IntersectionCount(b Bitset) (uint64, error) {
+	return t.applyCount(opAnd, b)
+}
+
+func (t *concurrent) UnionCount(b Bitset) (uint64, error) {
+	return t.applyCount(opOr, b)
+}
+
+func (t *concurrent) XorCount(b Bitset) (uint64, error) {
+	return t.applyCount(opXor, b)
+}
+
+func (t *concurrent) DifferenceCount(b Bitset) (uint64, error) {
+	return t.applyCount(opAndNot, b)
+}
+
+func (t *concurrent) Clone() Bitset {
+	return fromBitset(t.snapshot())
+}
+
+// MarshalBinary, WriteTo, ExportRoaring and ExportRoaring64 encode a view of
+// the tree (see view), with the stripes read-locked while it's written
+
+func (t *concurrent) MarshalBinary() ([]byte, error) {
+
+	t.rlockAll()
+	defer t.runlockAll()
+
+	return t.view().MarshalBinary()
+}
+
+func (t *concurrent) WriteTo(w io.Writer) (int64, error) {
+
+	t.rlockAll()
+	defer t.runlockAll()
+
+	return t.view().WriteTo(w)
+}
+
+func (t *concurrent) ExportRoaring(w io.Writer) (int64, error) {
+
+	t.rlockAll()
+	defer t.runlockAll()
+
+	return t.view().ExportRoaring(w)
+}
+
+func (t *concurrent) ExportRoaring64(w io.Writer) (int64, error) {
+
+	t.rlockAll()
+	defer t.runlockAll()
+
+	return t.view().ExportRoaring64(w)
+}
+
+// ReadFrom replaces the contents of the bitset with the binary encoding read
+// from the stream, which must have the same level layout as the bitset
+func (t *concurrent) ReadFrom(r io.Reader) (int64, error) {
+
+	c := &bitset{}
+
+	n, err := c.ReadFrom(r)
+
+	if err != nil {
+		return n, err
+	}
+
+	if !sameLevelBits(c.levelBits(), t.levelBits) {
+		return n, ErrLayoutMismatch
+	}
+
+	t.lockAll()
+	defer t.unlockAll()
+
+	t.load(c)
+
+	return n, nil
+}
+
+func (t *concurrent) UnmarshalBinary(data []byte) error {
+
+	c := &bitset{}
+
+	if err := c.UnmarshalBinary(data); err != nil {
+		return err
+	}
+
+	if !sameLevelBits(c.levelBits(), t.levelBits) {
+		return ErrLayoutMismatch
+	}
+
+	t.lockAll()
+	defer t.unlockAll()
+
+	t.load(c)
+
+	return nil
+}
+
+// Dump writes a view of the tree (see bitset.Dump), with the stripes
+// read-locked while it's written
+func (t *concurrent) Dump(w io.Writer, format DumpFormat) error {
+
+	t.rlockAll()
+	defer t.runlockAll()
+
+	return t.view().Dump(w, format)
+}
+
+// Stats returns the stats of the tree, with the stripes under a root inode
+func (t *concurrent) Stats() Stats {
+
+	t.rlockAll()
+	defer t.runlockAll()
+
+	if t.single {
+		return t.stripes[0].b.Stats()
+	}
+
+	rootLevel, _, _ := initLevels(t.levelBits)
+
+	var s Stats
+	s.Levels = make([]LevelStats, len(t.levelBits))
+
+	for l := rootLevel; l != nil; l = l.next {
+		s.Levels[rootLevel.height-l.height].Bits = l.bits
+	}
+
+	allSet, allClr := true, true
+
+	for i := range t.stripes {
+
+		b := t.stripes[i].b
+
+		allSet = allSet && b.All()
+		allClr = allClr && b.None()
+
+		nodeStats(b.rootLevel, b.root, s.Levels[1:])
+	}
+
+	// the root is materialized, unless all the stripes are sparse (in which
+	// case the root would be a sparse node too)
+	switch {
+	case allSet:
+		s.Levels[0].SetNodes, s.Levels[1].SetNodes = 1, 0
+
+	case allClr:
+		s.Levels[0].ClrNodes, s.Levels[1].ClrNodes = 1, 0
+
+	default:
+		s.Levels[0].Inodes = 1
+		s.Levels[0].Bytes = inodeBytes + childBytes*float64(len(t.stripes))
+	}
+
+	s.total(rootLevel)
+
+	return s
+}
+
+// sameLevelBits returns true if the two layouts are the same
+func sameLevelBits(a, b []uint) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,310 @@
+package bitset
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var concurrentNews = map[string]func(levelBits []uint) (Bitset, error){
+	"mutex":  NewConcurrent,
+	"atomic": NewAtomic,
+}
+
+func TestConcurrentMatchesBitset(t *testing.T) {
+
+	for name, newConcurrent := range concurrentNews {
+		for _, cfg := range configs {
+			t.Run(fmt.Sprintf("%s/%v", name, cfg), func(t *testing.T) {
+				testConcurrentMatchesBitset(t, cfg, newConcurrent)
+			})
+		}
+	}
+}
+
+func testConcurrentMatchesBitset(t *testing.T, cfg []uint, newConcurrent func([]uint) (Bitset, error)) {
+
+	b := New(cfg)
+	c, err := newConcurrent(cfg)
+	assert.NoError(t, err)
+
+	max := b.Max()
+
+	for _, x := range []Bitset{b, c} {
+		x.SetRange(max/4, max/2).Set(0).Set(max).Clear(max / 3).Flip(1)
+		x.FlipRange(max/2, max-max/4)
+		x.Swap(2, true)
+		x.SetRange(max+1, max+2).Flip(max + 1).Count() // no-ops, beyond Max()
+	}
+
+	assert.EqualValues(t, b.Count(), c.Count())
+	assert.EqualValues(t, b.Stats(), c.Stats())
+	assert.NoError(t, c.Validate())
+
+	for _, start := range []uint64{0, 1, max / 4, max / 2, max} {
+
+		i, found := b.NextSet(start)
+		j, cfound := c.NextSet(start)
+		assert.EqualValues(t, found, cfound)
+		assert.EqualValues(t, i, j)
+
+		i, found = b.PrevClear(start)
+		j, cfound = c.PrevClear(start)
+		assert.EqualValues(t, found, cfound)
+		assert.EqualValues(t, i, j)
+	}
+
+	var set []uint64
+
+	c.ForEachSet(func(idx uint64) bool {
+		set = append(set, idx)
+		return true
+	})
+
+	assert.EqualValues(t, b.Count(), len(set))
+
+	var seq []uint64
+
+	for idx := range c.SetBits() {
+		seq = append(seq, idx)
+	}
+
+	assert.EqualValues(t, set, seq)
+
+	for _, r := range [][2]uint64{{0, max}, {1, max / 3}, {max / 3, max}} {
+		assert.EqualValues(t, b.CountRange(r[0], r[1]), c.CountRange(r[0], r[1]))
+	}
+
+	for _, n := range []uint64{0, 1, b.Count() / 2, b.Count() - 1, b.Count()} {
+
+		i, found := b.Select(n)
+		j, cfound := c.Select(n)
+		assert.EqualValues(t, found, cfound)
+		assert.EqualValues(t, i, j)
+
+		assert.EqualValues(t, b.Rank(i), c.Rank(i))
+	}
+
+	// set operations, between either kind of bitset
+	n, err := c.XorCount(b)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, n)
+
+	r, err := c.Or(New(cfg).Set(max / 3).Clear(0))
+	assert.NoError(t, err)
+	assert.EqualValues(t, true, r.Test(max/3))
+
+	n, err = b.UnionCount(New(cfg).Set(max / 3))
+	assert.NoError(t, err)
+	assert.EqualValues(t, n, r.Count())
+
+	assert.NoError(t, b.InPlaceAnd(r))
+	assert.EqualValues(t, c.Count(), b.Count())
+
+	assert.NoError(t, c.InPlaceXor(c))
+	assert.EqualValues(t, true, c.None())
+	assert.EqualValues(t, 0, c.Count())
+
+	// encoding round trip
+	data, err := b.MarshalBinary()
+	assert.NoError(t, err)
+	assert.NoError(t, c.UnmarshalBinary(data))
+	assert.EqualValues(t, b.Count(), c.Count())
+	assert.EqualValues(t, b.Stats().NumNodes(), c.Stats().NumNodes())
+
+	d := c.Clone()
+	c.ClearAll()
+	assert.EqualValues(t, b.Count(), d.Count())
+
+	assert.EqualValues(t, true, c.SetAll().All())
+	assert.EqualValues(t, c.Cap(), c.Count())
+}
+
+func TestConcurrentParallelWriters(t *testing.T) {
+
+	for name, newConcurrent := range concurrentNews {
+		t.Run(name, func(t *testing.T) {
+			testConcurrentParallelWriters(t, newConcurrent)
+		})
+	}
+}
+
+func testConcurrentParallelWriters(t *testing.T, newConcurrent func([]uint) (Bitset, error)) {
+
+	c, err := newConcurrent([]uint{8, 8, 4})
+	assert.NoError(t, err)
+
+	const writers = 16
+
+	var wg sync.WaitGroup
+
+	for w := uint64(0); w < writers; w++ {
+
+		wg.Add(1)
+
+		go func(w uint64) {
+			defer wg.Done()
+
+			// each writer owns every writers-th bit: it sets all of them, and
+			// then clears every other one of them
+			for i := w; i <= c.Max(); i += writers {
+				c.Set(i)
+			}
+
+			for i := w + writers; i <= c.Max(); i += 2 * writers {
+				c.Clear(i)
+				c.NextSet(i)
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	var count uint64
+
+	for i := uint64(0); i <= c.Max(); i++ {
+
+		assert.EqualValues(t, (i/writers)%2 == 0, c.Test(i))
+
+		if c.Test(i) {
+			count++
+		}
+	}
+
+	assert.EqualValues(t, count, c.Count())
+	assert.EqualValues(t, c.Cap()/2, count)
+
+	// the per-inode counts (used by Rank) were kept up to date as well
+	assert.EqualValues(t, count, c.Rank(c.Max()-1))
+}
+
+func TestConcurrentReadersShareNothing(t *testing.T) {
+
+	for name, newConcurrent := range concurrentNews {
+		t.Run(name, func(t *testing.T) {
+
+			b, err := newConcurrent([]uint{8, 8, 4})
+			assert.NoError(t, err)
+
+			c := b.(*concurrent)
+			c.SetRange(100, 5000).Set(40000)
+
+			// the read-only ops work over a view of the stripes, so their
+			// nodes are not marked shared (and writes don't copy them)
+			n, err := c.IntersectionCount(c)
+			assert.NoError(t, err)
+			assert.EqualValues(t, 4902, n)
+
+			_, err = c.WriteTo(io.Discard)
+			assert.NoError(t, err)
+			assert.NoError(t, c.Dump(io.Discard, DumpText))
+			assert.EqualValues(t, c.Stats().NumNodes(), c.Stats().NumNodes())
+			assert.NoError(t, c.Validate())
+
+			for i := range c.stripes {
+				assert.False(t, c.stripes[i].b.rootLevel.owner.shared.Load(), "stripe %d", i)
+			}
+
+			// a snapshot (for an iterator) does share them
+			it := c.Iterator()
+			c.Clear(100)
+
+			idx, found := it.Next()
+			assert.True(t, found)
+			assert.EqualValues(t, 100, idx)
+			assert.NoError(t, c.Validate())
+		})
+	}
+}
+
+func TestConcurrentReadersWithWriters(t *testing.T) {
+
+	for name, newConcurrent := range concurrentNews {
+		t.Run(name, func(t *testing.T) {
+
+			c, err := newConcurrent([]uint{8, 8, 4})
+			assert.NoError(t, err)
+
+			var wg sync.WaitGroup
+
+			// writers in half of the stripes, readers over all of them (see
+			// go test -race)
+			for w := uint64(0); w < 4; w++ {
+
+				wg.Add(2)
+
+				go func(w uint64) {
+					defer wg.Done()
+
+					for i := w; i < c.Max()/2; i += 97 {
+						c.Set(i)
+					}
+				}(w)
+
+				go func() {
+					defer wg.Done()
+
+					for i := 0; i < 20; i++ {
+						_, err := c.UnionCount(c)
+						assert.NoError(t, err)
+
+						_, err = c.WriteTo(io.Discard)
+						assert.NoError(t, err)
+
+						for range c.SetBits() {
+							break
+						}
+					}
+				}()
+			}
+
+			wg.Wait()
+
+			assert.NoError(t, c.Validate())
+		})
+	}
+}
+
+func TestAtomicRacingSetClear(t *testing.T) {
+
+	for round := 0; round < 20; round++ {
+
+		b, err := NewAtomic([]uint{8, 8})
+		assert.NoError(t, err)
+
+		// a leaf with a single bit set, and with a single bit clear, which
+		// racing Set/Clear of that bit must not leave materialized when they
+		// empty (or fill) it
+		b.Set(5)
+		b.SetRange(256, 511).Clear(300)
+
+		var wg sync.WaitGroup
+
+		for w := 0; w < 8; w++ {
+
+			wg.Add(1)
+
+			go func(w int) {
+				defer wg.Done()
+
+				for i := 0; i < 1000; i++ {
+
+					if (w+i)%2 == 0 {
+						b.Set(5).Set(300)
+					} else {
+						b.Clear(5).Clear(300)
+					}
+				}
+			}(w)
+		}
+
+		wg.Wait()
+
+		assert.NoError(t, b.Validate())
+		assert.EqualValues(t, b.Test(5), b.CountRange(0, 255) == 1)
+		assert.EqualValues(t, b.Test(300), b.CountRange(256, 511) == 256)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build bitset_debug
+
+package bitset
+
+// debugValidate validates the tree after each modification, when built with
+// the 'bitset_debug' tag, panicking on the first inconsistency found
+func (t *bitset) debugValidate() {
+
+	if err := t.Validate(); err != nil {
+		panic(err)
+	}
+}
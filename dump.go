@@ -0,0 +1,201 @@
+package bitset
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+)
+
+type (
+	// DumpFormat is the format in which Dump renders the tree
+	DumpFormat int
+
+	// dumper renders the tree, keeping the first error from the writer
+	dumper struct {
+		w      io.Writer
+		format DumpFormat
+		ids    int // ids of the DOT nodes
+		err    error
+	}
+)
+
+const (
+	// DumpText renders the tree as indented text, a node per line
+	DumpText DumpFormat = iota
+
+	// DumpDot renders the tree as a Graphviz DOT digraph
+	DumpDot
+)
+
+func (f DumpFormat) String() string {
+
+	switch f {
+	case DumpText:
+		return "text"
+
+	case DumpDot:
+		return "dot"
+	}
+
+	return fmt.Sprintf("DumpFormat(%d)", int(f))
+}
+
+// Dump writes the tree to w in the given format, with the index range, kind
+// and population of each node; runs of adjacent sparse children of the same
+// kind are collapsed into a single node
+func (t *bitset) Dump(w io.Writer, format DumpFormat) error {
+
+	d := &dumper{w: w, format: format}
+
+	switch format {
+	case DumpText:
+		d.text(t.rootLevel, t.root, 0, 1, 0)
+
+	case DumpDot:
+		d.printf("digraph bitset {\n\tnode [shape=box, fontname=monospace];\n")
+		d.dot(t.rootLevel, t.root, 0, 1)
+		d.printf("}\n")
+
+	default:
+		return fmt.Errorf("bitset: unknown dump format %v", format)
+	}
+
+	return d.err
+}
+
+func (d *dumper) printf(f string, a ...interface{}) {
+
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, f, a...)
+	}
+}
+
+// describe returns the kind and population of n, a node at level l (or a
+// run of 'num' sparse nodes)
+func describe(l *level, n node, num int) string {
+
+	switch n := n.(type) {
+	case *setnode:
+
+		// num << (shift+bits) (as a big.Int, since it's 2^64 for the root of
+		// a 64-bit layout, where l.max+1 wraps to 0)
+		set := new(big.Int).Lsh(big.NewInt(int64(num)), l.shift+l.bits)
+
+		if num > 1 {
+			return fmt.Sprintf("setnode x%d set=%v", num, set)
+		}
+
+		return fmt.Sprintf("setnode set=%v", set)
+
+	case *clrnode:
+
+		if num > 1 {
+			return fmt.Sprintf("clrnode x%d set=0", num)
+		}
+
+		return "clrnode set=0"
+
+	case *inode:
+		return fmt.Sprintf("inode set=%d (%d children: %d set, %d clr)",
+			n.numSet, len(n.nodes), n.nSet, n.nClr)
+
+	case *leaf:
+		return fmt.Sprintf("leaf set=%d", n.numSet)
+
+	case *arrayleaf:
+		return fmt.Sprintf("arrayleaf set=%d", len(n.offsets))
+
+	case *runleaf:
+		return fmt.Sprintf("runleaf set=%d (%d runs)", n.numSet, len(n.runs))
+	}
+
+	return fmt.Sprintf("%T", n)
+}
+
+// children calls 'do' for each child of the inode, or for each run of its
+// sparse children of the same kind, with the index and number of them
+func children(in *inode, do func(i, num int)) {
+
+	for i := 0; i < len(in.nodes); {
+
+		num := 1
+
+		if isSparse(in.nodes[i]) {
+			for i+num < len(in.nodes) && sameSparse(in.nodes[i], in.nodes[i+num]) {
+				num++
+			}
+		}
+
+		do(i, num)
+
+		i += num
+	}
+}
+
+func isSparse(n node) bool {
+
+	switch n.(type) {
+	case *setnode, *clrnode:
+		return true
+	}
+
+	return false
+}
+
+func sameSparse(a, b node) bool {
+
+	switch a.(type) {
+	case *setnode:
+		_, ok := b.(*setnode)
+		return ok
+
+	case *clrnode:
+		_, ok := b.(*clrnode)
+		return ok
+	}
+
+	return false
+}
+
+// text renders the node (or the run of 'num' sparse nodes) starting at base
+func (d *dumper) text(l *level, n node, base uint64, num int, depth int) {
+
+	last := base + uint64(num)*(l.max+1) - 1
+
+	d.printf("%s[%d, %d] %s\n", strings.Repeat("  ", depth), base, last, describe(l, n, num))
+
+	if in, ok := n.(*inode); ok {
+
+		children(in, func(i, num int) {
+			d.text(l.next, in.nodes[i], base+uint64(i)<<l.shift, num, depth+1)
+		})
+	}
+}
+
+// dot renders the node (or the run of 'num' sparse nodes) starting at base,
+// and returns its id
+func (d *dumper) dot(l *level, n node, base uint64, num int) (id int) {
+
+	id, d.ids = d.ids, d.ids+1
+
+	last := base + uint64(num)*(l.max+1) - 1
+
+	style := ""
+
+	if isSparse(n) {
+		style = ", style=dashed"
+	}
+
+	d.printf("\tn%d [label=\"[%d, %d]\\n%s\"%s];\n", id, base, last, describe(l, n, num), style)
+
+	if in, ok := n.(*inode); ok {
+
+		children(in, func(i, num int) {
+			child := d.dot(l.next, in.nodes[i], base+uint64(i)<<l.shift, num)
+			d.printf("\tn%d -> n%d;\n", id, child)
+		})
+	}
+
+	return id
+}
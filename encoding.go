@@ -0,0 +1,335 @@
+package bitset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// The binary encoding of a bitset is a header describing its level layout,
+// followed by its tree of nodes in pre-order:
+//
+//	magic    [4]byte  "BSET"
+//	version  uint8
+//	nlevels  uint8
+//	bits     [nlevels]uint8  (leaf level first)
+//	tree     node
+//
+// where each node is a single tag byte, followed by its children (for an
+// inode) or its bits, as little-endian uint64 words (for a leaf, of any
+// kind); sparse setnode/clrnode subtrees are encoded with just their tag.
+
+const (
+	encVersion = 1
+
+	tagClr   = 0
+	tagSet   = 1
+	tagInode = 2
+	tagLeaf  = 3
+
+	// the decoder allocates the words of a leaf, and the children of an
+	// inode, at most this many at a time, as they are read
+	decodeChunk = 1 << 12
+)
+
+var (
+	encMagic = [4]byte{'B', 'S', 'E', 'T'}
+
+	// ErrInvalidEncoding is returned when decoding malformed binary data
+	ErrInvalidEncoding = errors.New("bitset: invalid encoding")
+)
+
+type (
+	encoder struct {
+		w   io.Writer
+		n   int64  // bytes written
+		buf []byte // scratch buffer (sized for a leaf)
+	}
+
+	decoder struct {
+		r   io.Reader
+		n   int64  // bytes read
+		buf []byte // scratch buffer (sized for a leaf)
+	}
+)
+
+func (e *encoder) write(b []byte) error {
+
+	n, err := e.w.Write(b)
+	e.n += int64(n)
+
+	return err
+}
+
+func (e *encoder) encode(l *level, n node) error {
+
+	switch n := n.(type) {
+	case *setnode:
+		return e.write([]byte{tagSet})
+
+	case *clrnode:
+		return e.write([]byte{tagClr})
+
+	case *inode:
+
+		if err := e.write([]byte{tagInode}); err != nil {
+			return err
+		}
+
+		for _, next := range n.nodes {
+
+			if err := e.encode(l.next, next); err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	default: // leaf, of any kind
+
+		words := leafBits(l, n)
+
+		buf := e.buf[:1+8*len(words)]
+
+		buf[0] = tagLeaf
+
+		for i, w := range words {
+			binary.LittleEndian.PutUint64(buf[1+8*i:], w)
+		}
+
+		return e.write(buf)
+	}
+}
+
+func (d *decoder) read(b []byte) error {
+
+	n, err := io.ReadFull(d.r, b)
+	d.n += int64(n)
+
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func (d *decoder) decode(l *level) (n node, err error) {
+
+	tag := d.buf[:1]
+
+	if err = d.read(tag); err != nil {
+		return nil, err
+	}
+
+	switch tag[0] {
+	case tagSet:
+		return newNode(l, true, true), nil
+
+	case tagClr:
+		return newNode(l, true, false), nil
+
+	case tagInode:
+
+		if l.leaf {
+			return nil, ErrInvalidEncoding
+		}
+
+		// the children are added as they're decoded (rather than allocated
+		// up front), so a header with a wide level can't exhaust memory
+		in := &inode{owner: l.token(), nodes: make([]node, 0, min(l.total, decodeChunk))}
+		l.numNodes++ // #stats
+
+		for len(in.nodes) < l.total {
+
+			next, err := d.decode(l.next)
+
+			if err != nil {
+				return nil, err
+			}
+
+			in.nodes = append(in.nodes, nil)
+			in.replace(len(in.nodes)-1, next)
+		}
+
+		in.nodes = exact(in.nodes)
+		in.numSet = in.recount(l)
+
+		return in.compact(l), nil
+
+	case tagLeaf:
+
+		if !l.leaf {
+			return nil, ErrInvalidEncoding
+		}
+
+		words := leafWords(l)
+
+		// the words are read a buffer at a time, and the leaf grows as they
+		// arrive, like the children of an inode
+		n := &leaf{owner: l.token(), bits: make([]uint64, 0, min(words, decodeChunk))}
+		l.numNodes++ // #stats
+
+		for len(n.bits) < words {
+
+			buf := d.buf[:8*min(words-len(n.bits), len(d.buf)/8)]
+
+			if err = d.read(buf); err != nil {
+				return nil, err
+			}
+
+			for i := 0; i < len(buf); i += 8 {
+				w := binary.LittleEndian.Uint64(buf[i:])
+				n.bits = append(n.bits, w)
+				n.numSet += bits.OnesCount64(w)
+			}
+		}
+
+		n.bits = exact(n.bits)
+
+		// bits beyond the size of the leaf must not be set
+		if l.total%64 != 0 && n.bits[words-1]>>(uint(l.total)%64) != 0 {
+			return nil, ErrInvalidEncoding
+		}
+
+		return pack(l, n), nil
+	}
+
+	return nil, ErrInvalidEncoding
+}
+
+// exact returns the slice with no spare capacity (copying it, if it has any)
+func exact[S ~[]E, E any](s S) S {
+
+	if cap(s) == len(s) {
+		return s
+	}
+
+	return append(S(nil), s...)
+}
+
+// levelBits returns the 'levelBits' that t was created with
+func (t *bitset) levelBits() []uint {
+
+	levelBits := make([]uint, t.rootLevel.height+1)
+
+	for l := t.rootLevel; l != nil; l = l.next {
+		levelBits[l.height] = l.bits
+	}
+
+	return levelBits
+}
+
+// leafWords returns the number of uint64 words in a leaf of the hierarchy
+func leafWords(l *level) int {
+
+	for !l.leaf {
+		l = l.next
+	}
+
+	return 1 + ((l.total - 1) / 64)
+}
+
+// WriteTo writes the binary encoding of the bitset to the stream; only the
+// header and one leaf worth of bits is buffered at any time
+func (t *bitset) WriteTo(w io.Writer) (int64, error) {
+
+	levelBits := t.levelBits()
+
+	hdr := append(encMagic[:], encVersion, uint8(len(levelBits)))
+
+	for _, b := range levelBits {
+		hdr = append(hdr, uint8(b))
+	}
+
+	e := &encoder{
+		w:   w,
+		buf: make([]byte, 1+8*leafWords(t.rootLevel)),
+	}
+
+	if err := e.write(hdr); err != nil {
+		return e.n, err
+	}
+
+	err := e.encode(t.rootLevel, t.root)
+
+	return e.n, err
+}
+
+// ReadFrom replaces the contents (and the level layout) of the bitset with
+// the binary encoding read from the stream; the stream is read exactly up
+// to the end of the encoding, so it's best for it to be buffered
+func (t *bitset) ReadFrom(r io.Reader) (int64, error) {
+
+	d := &decoder{r: r, buf: make([]byte, 6)}
+
+	hdr := d.buf[:6]
+
+	if err := d.read(hdr); err != nil {
+		return d.n, err
+	}
+
+	if !bytes.Equal(hdr[:4], encMagic[:]) || hdr[4] != encVersion || hdr[5] == 0 {
+		return d.n, ErrInvalidEncoding
+	}
+
+	lb := make([]byte, hdr[5])
+
+	if err := d.read(lb); err != nil {
+		return d.n, err
+	}
+
+	levelBits := make([]uint, len(lb))
+
+	for i, b := range lb {
+		levelBits[i] = uint(b)
+	}
+
+	rootLevel, max, err := initLevels(levelBits)
+
+	if err != nil {
+		return d.n, ErrInvalidEncoding
+	}
+
+	d.buf = make([]byte, 8*min(leafWords(rootLevel), decodeChunk))
+
+	root, err := d.decode(rootLevel)
+
+	if err != nil {
+		return d.n, err
+	}
+
+	t.root, t.rootLevel, t.max = root, rootLevel, max
+	t.count = root.count(rootLevel)
+
+	t.debugValidate()
+
+	return d.n, nil
+}
+
+func (t *bitset) MarshalBinary() ([]byte, error) {
+
+	var buf bytes.Buffer
+
+	if _, err := t.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (t *bitset) UnmarshalBinary(data []byte) error {
+
+	n, err := t.ReadFrom(bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	if n != int64(len(data)) {
+		return ErrInvalidEncoding // trailing data
+	}
+
+	return nil
+}
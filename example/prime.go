@@ -1,8 +1,9 @@
 package main
 
 import (
-	"bitset"
 	"fmt"
+
+	"github.com/kirg/bitset"
 )
 
 func main() {
@@ -39,5 +40,5 @@ func main() {
 		}
 	}
 
-	fmt.Printf("\nfound %d primes under %d (stats=%v)\n", b.Count(), b.Max(), b.Stats())
+	fmt.Printf("\nfound %d primes under %d (stats=%v)\n", b.Count(), b.Max(), b.Stats().NumNodes())
 }
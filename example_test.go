@@ -1,9 +1,9 @@
 package bitset_test
 
 import (
-	"bitset"
-
 	"fmt"
+
+	"github.com/kirg/bitset"
 )
 
 func ExampleBitset() {
@@ -0,0 +1,297 @@
+package bitset
+
+import (
+	"math/bits"
+	"testing"
+)
+
+// flat is the naive reference bitmap the fuzz targets compare against
+type flat []uint64
+
+func newFlat(max uint64) flat {
+	return make(flat, max/64+1)
+}
+
+func (f flat) test(idx uint64) bool {
+	return f[idx/64]&(1<<(idx%64)) != 0
+}
+
+func (f flat) set(idx uint64, set bool) (changed bool) {
+
+	changed = f.test(idx) != set
+
+	if set {
+		f[idx/64] |= 1 << (idx % 64)
+	} else {
+		f[idx/64] &^= 1 << (idx % 64)
+	}
+
+	return changed
+}
+
+func (f flat) count() (n uint64) {
+
+	for _, w := range f {
+		n += uint64(bits.OnesCount64(w))
+	}
+
+	return n
+}
+
+// next/prev return the first bit at or after (before) start that is set
+// (or clear), up to max
+func (f flat) next(start, max uint64, set bool) (uint64, bool) {
+
+	for i := start; i <= max; i++ {
+		if f.test(i) == set {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+func (f flat) prev(start, max uint64, set bool) (uint64, bool) {
+
+	if start > max {
+		start = max
+	}
+
+	for i := int64(start); i >= 0; i-- {
+		if f.test(uint64(i)) == set {
+			return uint64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// fuzzLayout decodes a level layout of up to 16 bits (so the reference stays
+// small) from the first bytes of data: the number of levels, then a byte for
+// each level; it returns the layout with the rest of data
+func fuzzLayout(data []byte) (levelBits []uint, rest []byte) {
+
+	if len(data) == 0 {
+		return []uint{8}, data
+	}
+
+	// 1-4 levels, of 0-7 bits each (1-8 for the leaf)
+	levels := 1 + int(data[0]&3)
+	data = data[1:]
+
+	var total uint
+
+	for i := 0; i < levels && total < 16; i++ {
+
+		var n uint
+
+		if len(data) > 0 {
+			n, data = uint(data[0])&7, data[1:]
+		}
+
+		if i == 0 {
+			n++
+		}
+
+		n = min(n, 16-total)
+		total += n
+
+		levelBits = append(levelBits, n)
+	}
+
+	return levelBits, data
+}
+
+// fuzz ops, each an opcode byte and two 16-bit indexes
+const (
+	fuzzSet = iota
+	fuzzClear
+	fuzzFlip
+	fuzzSwap
+	fuzzSetAll
+	fuzzClearAll
+	fuzzSetRange
+	fuzzClearRange
+	fuzzFlipRange
+	fuzzNextSet
+	fuzzNextClear
+	fuzzPrevSet
+	fuzzPrevClear
+	fuzzForEachSetRange
+	fuzzCountRange
+	fuzzNumOps
+)
+
+func FuzzBitset(f *testing.F) {
+
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x01, 7, 3, fuzzSet, 0, 3, 0, 0, fuzzSwap, 0, 3, 0, 0, fuzzNextSet, 0, 0, 0, 0})
+	f.Add([]byte{0x02, 7, 3, 5, fuzzSetAll, 0, 0, 0, 0, fuzzClear, 0, 7, 0, 0, fuzzPrevClear, 0xff, 0xff, 0, 0})
+	f.Add([]byte{0x03, 3, 2, 4, 1, fuzzSetRange, 0, 10, 2, 0, fuzzFlipRange, 1, 0, 3, 0, fuzzForEachSetRange, 0, 5, 1, 9})
+	f.Add([]byte{0x02, 0, 4, 2, fuzzSetRange, 0, 0, 0xff, 0xff, fuzzClearRange, 0, 1, 0xff, 0xfe, fuzzCountRange, 0, 0, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+
+		levelBits, data := fuzzLayout(data)
+
+		b := New(levelBits)
+
+		if b == nil {
+			t.Fatalf("layout %v", levelBits)
+		}
+
+		max := b.Max()
+		ref := newFlat(max)
+
+		for i := 0; len(data) >= 5; i, data = i+1, data[5:] {
+
+			op := data[0] % fuzzNumOps
+			idx := (uint64(data[1])<<8 | uint64(data[2])) % (max + 1)
+			end := (uint64(data[3])<<8 | uint64(data[4])) % (max + 1)
+
+			if idx > end && op >= fuzzSetRange && op <= fuzzFlipRange {
+				idx, end = end, idx
+			}
+
+			switch op {
+			case fuzzSet:
+				b.Set(idx)
+				ref.set(idx, true)
+
+			case fuzzClear:
+				b.Clear(idx)
+				ref.set(idx, false)
+
+			case fuzzFlip:
+				b.Flip(idx)
+				ref.set(idx, !ref.test(idx))
+
+			case fuzzSwap:
+				set := end%2 == 0
+
+				if got, want := b.Swap(idx, set), ref.set(idx, set); got != want {
+					t.Fatalf("op %d: Swap(%d, %v) = %v, want %v", i, idx, set, got, want)
+				}
+
+			case fuzzSetAll:
+				b.SetAll()
+
+				for j := range ref {
+					ref[j] = 0
+				}
+
+				for j := uint64(0); j <= max; j++ {
+					ref.set(j, true)
+				}
+
+			case fuzzClearAll:
+				b.ClearAll()
+
+				for j := range ref {
+					ref[j] = 0
+				}
+
+			case fuzzSetRange, fuzzClearRange, fuzzFlipRange:
+
+				switch op {
+				case fuzzSetRange:
+					b.SetRange(idx, end)
+
+				case fuzzClearRange:
+					b.ClearRange(idx, end)
+
+				case fuzzFlipRange:
+					b.FlipRange(idx, end)
+				}
+
+				for j := idx; j <= end; j++ {
+					ref.set(j, op == fuzzSetRange || op == fuzzFlipRange && !ref.test(j))
+				}
+
+			case fuzzNextSet, fuzzNextClear, fuzzPrevSet, fuzzPrevClear:
+
+				var got, want uint64
+				var found, wantFound bool
+
+				switch op {
+				case fuzzNextSet:
+					got, found = b.NextSet(idx)
+					want, wantFound = ref.next(idx, max, true)
+
+				case fuzzNextClear:
+					got, found = b.NextClear(idx)
+					want, wantFound = ref.next(idx, max, false)
+
+				case fuzzPrevSet:
+					got, found = b.PrevSet(idx)
+					want, wantFound = ref.prev(idx, max, true)
+
+				case fuzzPrevClear:
+					got, found = b.PrevClear(idx)
+					want, wantFound = ref.prev(idx, max, false)
+				}
+
+				if found != wantFound || found && got != want {
+					t.Fatalf("op %d (%d) from %d: got %d/%v, want %d/%v", i, op, idx, got, found, want, wantFound)
+				}
+
+			case fuzzForEachSetRange:
+
+				// stop early after a few, as callers do
+				var got []uint64
+
+				b.ForEachSetRange(idx, end, func(j uint64) bool {
+					got = append(got, j)
+					return len(got) < 4
+				})
+
+				var want []uint64
+
+				for j := idx; j <= end && len(want) < 4; j++ {
+					if ref.test(j) {
+						want = append(want, j)
+					}
+				}
+
+				if len(got) != len(want) {
+					t.Fatalf("op %d: ForEachSetRange(%d, %d) = %v, want %v", i, idx, end, got, want)
+				}
+
+				for k := range got {
+					if got[k] != want[k] {
+						t.Fatalf("op %d: ForEachSetRange(%d, %d) = %v, want %v", i, idx, end, got, want)
+					}
+				}
+
+			case fuzzCountRange:
+
+				var want uint64
+
+				for j := idx; j <= end; j++ {
+					if ref.test(j) {
+						want++
+					}
+				}
+
+				if got := b.CountRange(idx, end); got != want {
+					t.Fatalf("op %d: CountRange(%d, %d) = %d, want %d", i, idx, end, got, want)
+				}
+			}
+
+			if got, want := b.Count(), ref.count(); got != want {
+				t.Fatalf("op %d (%d): Count() = %d, want %d", i, op, got, want)
+			}
+
+			if err := b.Validate(); err != nil {
+				t.Fatalf("op %d (%d): %v", i, op, err)
+			}
+		}
+
+		// a final comparison of all the bits
+		for j := uint64(0); j <= max; j++ {
+			if b.Test(j) != ref.test(j) {
+				t.Fatalf("bit %d: got %v, want %v", j, b.Test(j), ref.test(j))
+			}
+		}
+	})
+}
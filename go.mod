@@ -0,0 +1,10 @@
+module github.com/kirg/bitset
+
+go 1.23
+
+require (
+	github.com/stretchr/testify v1.12.1
+	github.com/willf/bitset v1.1.11
+)
+
+require go.yaml.in/yaml/v3 v3.0.5 // indirect
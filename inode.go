@@ -7,8 +7,9 @@ import (
 
 type (
 	inode struct {
-		level      *level // level context
+		owner      *owner // owner of the node (see level.owns)
 		nSet, nClr int    // nodes that are all-set, all-clr
+		numSet     uint64 // number of bits set under the inode (mod 2^64)
 		nodes      []node // child (inode/leaf) nodes
 	}
 )
@@ -22,10 +23,11 @@ func newInodeSet(l *level) *inode {
 	}
 
 	return &inode{
-		level: l,
-		nSet:  l.total,
-		nClr:  0,
-		nodes: nodes,
+		owner:  l.token(),
+		nSet:   l.total,
+		nClr:   0,
+		numSet: l.max + 1, // NB: wraps to 0 with 64 bits, until a bit is cleared
+		nodes:  nodes,
 	}
 }
 
@@ -38,7 +40,7 @@ func newInodeClr(l *level) *inode {
 	}
 
 	return &inode{
-		level: l,
+		owner: l.token(),
 		nSet:  0,
 		nClr:  l.total,
 		nodes: nodes,
@@ -74,6 +76,11 @@ func (in *inode) set(l *level, idx uint64) (set bool, replace node) {
 	// propagate down the 'set'
 	set, repl := next.set(l.next, idx)
 
+	if set {
+		in = in.own(l) // copy-on-write, if shared
+		in.numSet++
+	}
+
 	if repl == next {
 		// node not replaced, just return
 		return set, in
@@ -83,6 +90,8 @@ func (in *inode) set(l *level, idx uint64) (set bool, replace node) {
 
 	// assert( set == true )
 
+	in = in.own(l) // copy-on-write, if shared
+
 	// update nSet/nClr based on node being replaced
 	switch next.(type) {
 	case *setnode:
@@ -121,6 +130,11 @@ func (in *inode) clr(l *level, idx uint64) (cleared bool, replace node) {
 	// propagate down the 'clr'
 	cleared, repl := next.clr(l.next, idx)
 
+	if cleared {
+		in = in.own(l) // copy-on-write, if shared
+		in.numSet--
+	}
+
 	if repl == next {
 		// node not replaced, just return
 		return cleared, in
@@ -130,6 +144,8 @@ func (in *inode) clr(l *level, idx uint64) (cleared bool, replace node) {
 
 	// assert( cleared == true ) //
 
+	in = in.own(l) // copy-on-write, if shared
+
 	// update nSet/nClr based on node being replaced
 	switch next.(type) {
 	case *setnode:
@@ -159,19 +175,251 @@ func (in *inode) clr(l *level, idx uint64) (cleared bool, replace node) {
 	return true, in
 }
 
-func (n *inode) nextset(l *level, start uint64) (idx uint64, found bool) {
+func (in *inode) setrange(l *level, start, end uint64) (changed uint64, replace node) {
+	return in.rangeop(l, start, end, true)
+}
+
+func (in *inode) clrrange(l *level, start, end uint64) (changed uint64, replace node) {
+	return in.rangeop(l, start, end, false)
+}
 
-	i, idx := int(start>>l.shift), start&l.mask
+// rangeop sets/clears the bits in [start, end], propagating the range down
+// to each child node that it overlaps; children that are fully covered are
+// replaced with sparse nodes, with the change taken from their counts
+// (without scanning the bits under them)
+func (in *inode) rangeop(l *level, start, end uint64, set bool) (changed uint64, replace node) {
 
-	if i >= l.total {
-		return 0, false
+	first, last := int(start>>l.shift), int(end>>l.shift)
+
+	for i := first; i <= last; i++ {
+
+		lo, hi := uint64(0), l.mask
+
+		if i == first {
+			lo = start & l.mask
+		}
+
+		if i == last {
+			hi = end & l.mask
+		}
+
+		next := in.nodes[i]
+
+		var n uint64
+		var repl node
+
+		switch {
+		case lo == 0 && hi == l.mask && !isSparse(next):
+
+			if n = next.count(l.next); set {
+				n = l.mask + 1 - n
+			}
+
+			repl = sparsify(l.next, next, set)
+
+		case set:
+			n, repl = next.setrange(l.next, lo, hi)
+
+		default:
+			n, repl = next.clrrange(l.next, lo, hi)
+		}
+
+		changed += n
+
+		if repl != next {
+			in = in.own(l) // copy-on-write, if shared
+			in.replace(i, repl)
+		}
 	}
 
-	for ; i < l.total; i++ {
+	if changed != 0 {
 
-		next := n.nodes[i]
+		in = in.own(l) // copy-on-write, if shared
+
+		if set {
+			in.numSet += changed
+		} else {
+			in.numSet -= changed
+		}
+	}
+
+	return changed, in.compact(l)
+}
+
+// fliprange flips the bits in [start, end]; sparse children that are fully
+// covered are swapped in place, so the cost is bounded by the number of
+// materialized nodes in the range
+func (in *inode) fliprange(l *level, start, end uint64) (set, cleared uint64, replace node) {
+
+	first, last := int(start>>l.shift), int(end>>l.shift)
+
+	for i := first; i <= last; i++ {
+
+		lo, hi := uint64(0), l.mask
+
+		if i == first {
+			lo = start & l.mask
+		}
+
+		if i == last {
+			hi = end & l.mask
+		}
+
+		next := in.nodes[i]
+
+		s, c, repl := next.fliprange(l.next, lo, hi)
+
+		set, cleared = set+s, cleared+c
+
+		if repl != next {
+			in = in.own(l) // copy-on-write, if shared
+			in.replace(i, repl)
+		}
+	}
+
+	if set != cleared {
+		in = in.own(l) // copy-on-write, if shared
+		in.numSet += set - cleared
+	}
+
+	return set, cleared, in.compact(l)
+}
+
+func (in *inode) count(l *level) (set uint64) {
+	return in.numSet
+}
+
+// recount returns the number of bits set under the inode, summed from its
+// children; for when the children were replaced wholesale, with replace
+func (in *inode) recount(l *level) (set uint64) {
+
+	for _, next := range in.nodes {
+		set += next.count(l.next)
+	}
+
+	return set
+}
+
+// nthset returns the index of the n-th set bit (counting from 0) under the
+// inode, skipping over whole children by their counts; n must be less than
+// the count of the inode
+func (in *inode) nthset(l *level, n uint64) (idx uint64) {
+
+	for i, next := range in.nodes {
 
-		if idx, found = next.nextset(l.next, idx); found {
+		c := next.count(l.next)
+
+		if n < c {
+			return (uint64(i) << l.shift) | next.nthset(l.next, n)
+		}
+
+		n -= c
+	}
+
+	return math.MaxUint64 // not reached
+}
+
+// countrange returns the number of bits set in [start, end]; children that
+// are fully covered are counted without scanning their bits
+func (in *inode) countrange(l *level, start, end uint64) (set uint64) {
+
+	first, last := int(start>>l.shift), int(end>>l.shift)
+
+	for i := first; i <= last; i++ {
+
+		lo, hi := uint64(0), l.mask
+
+		if i == first {
+			lo = start & l.mask
+		}
+
+		if i == last {
+			hi = end & l.mask
+		}
+
+		if next := in.nodes[i]; lo == 0 && hi == l.mask {
+			set += next.count(l.next)
+		} else {
+			set += next.countrange(l.next, lo, hi)
+		}
+	}
+
+	return set
+}
+
+// own returns the inode itself if it's owned by the tree of level l (ie, by
+// the bitset that is modifying it); otherwise the inode is shared with a clone,
+// and a copy of it (sharing the child nodes) is returned to be modified
+func (in *inode) own(l *level) *inode {
+
+	if l.owns(in.owner) {
+		return in
+	}
+
+	return &inode{
+		owner:  l.token(),
+		nSet:   in.nSet,
+		nClr:   in.nClr,
+		numSet: in.numSet,
+		nodes:  append([]node(nil), in.nodes...),
+	}
+}
+
+// replace replaces the child node at index i, updating nSet/nClr; numSet is
+// left for the caller to update (see recount)
+func (in *inode) replace(i int, repl node) {
+
+	// update nSet/nClr based on node being replaced
+	switch in.nodes[i].(type) {
+	case *setnode:
+		in.nSet--
+
+	case *clrnode:
+		in.nClr--
+	}
+
+	in.nodes[i] = repl // replace node
+
+	// update nSet/nClr based on new node
+	switch repl.(type) {
+	case *setnode:
+		in.nSet++
+
+	case *clrnode:
+		in.nClr++
+	}
+}
+
+// compact returns a sparse node to replace the inode with, if all of its
+// children are all-set or all-clr; otherwise it returns the inode itself
+func (in *inode) compact(l *level) (replace node) {
+
+	switch {
+	case in.nSet == l.total:
+		return sparsify(l, in, true)
+
+	case in.nClr == l.total:
+		return sparsify(l, in, false)
+	}
+
+	return in
+}
+
+func (n *inode) nextset(l *level, start, end uint64) (idx uint64, found bool) {
+
+	i, idx := int(start>>l.shift), start&l.mask
+	last, lastEnd := int(end>>l.shift), end&l.mask
+
+	for ; i <= last; i++ {
+
+		// only the last child searched is bounded by 'end'
+		nextEnd := l.mask
+
+		if i == last {
+			nextEnd = lastEnd
+		}
+
+		if idx, found = n.nodes[i].nextset(l.next, idx, nextEnd); found {
 			return (uint64(i) << l.shift) | idx, true
 		}
 
@@ -203,19 +451,21 @@ func (n *inode) prevset(l *level, start uint64) (idx uint64, found bool) {
 	return 0, false
 }
 
-func (n *inode) nextclr(l *level, start uint64) (idx uint64, found bool) {
+func (n *inode) nextclr(l *level, start, end uint64) (idx uint64, found bool) {
 
 	i, idx := int(start>>l.shift), start&l.mask
+	last, lastEnd := int(end>>l.shift), end&l.mask
 
-	if i >= l.total {
-		return 0, false
-	}
+	for ; i <= last; i++ {
 
-	for ; i < l.total; i++ {
+		// only the last child searched is bounded by 'end'
+		nextEnd := l.mask
 
-		next := n.nodes[i]
+		if i == last {
+			nextEnd = lastEnd
+		}
 
-		if idx, found = next.nextclr(l.next, idx); found {
+		if idx, found = n.nodes[i].nextclr(l.next, idx, nextEnd); found {
 			return (uint64(i) << l.shift) | idx, true
 		}
 
@@ -248,6 +498,6 @@ func (n *inode) prevclr(l *level, start uint64) (idx uint64, found bool) {
 }
 
 func (n *inode) String() string {
-	return fmt.Sprintf("inode(%p): level=%p nSet=%d nClr=%d nodes=%v",
-		n, n.level, n.nSet, n.nClr, n.nodes)
+	return fmt.Sprintf("inode(%p): owner=%p nSet=%d nClr=%d nodes=%v",
+		n, n.owner, n.nSet, n.nClr, n.nodes)
 }
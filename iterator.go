@@ -0,0 +1,297 @@
+package bitset
+
+type (
+	// Iterator steps through the set bits of a bitset, in either direction.
+	// It keeps its path through the tree (and the current leaf), so stepping
+	// to the next set bit does not restart the search from the root.
+	//
+	// Modifying the bitset invalidates the iterator, until it's repositioned
+	// with Seek or Reset.
+	Iterator struct {
+		t *bitset
+
+		path []iterFrame // inodes from the root down to 'node'
+
+		node node   // current leaf or setnode
+		nl   *level // level of 'node'
+		base uint64 // index of the first bit of 'node'
+		idx  uint64 // current index
+
+		state iterState
+	}
+
+	// iterFrame is an inode on the iterator's path, with the index of the
+	// child being visited
+	iterFrame struct {
+		in   *inode
+		l    *level
+		i    int
+		base uint64 // index of the first bit of 'in'
+	}
+
+	iterState int
+)
+
+const (
+	iterReset  iterState = iota // reset: Next goes to the first set bit, Prev to the last
+	iterBefore                  // before the first set bit
+	iterAt                      // at a set bit
+	iterAfter                   // after the last set bit
+)
+
+// Iterator returns a new iterator, in its reset state (see Reset)
+func (t *bitset) Iterator() *Iterator {
+	return &Iterator{t: t}
+}
+
+// Reset unpositions the iterator; Next will then return the first set bit
+// and Prev the last
+func (it *Iterator) Reset() {
+
+	it.path = it.path[:0]
+	it.node = nil
+	it.state = iterReset
+}
+
+// Seek positions the iterator at the first set bit at or after idx,
+// returning it; if there is none, the iterator is positioned after the last
+// set bit
+func (it *Iterator) Seek(idx uint64) (uint64, bool) {
+
+	it.Reset()
+
+	if idx > it.t.max {
+		it.state = iterAfter
+		return 0, false
+	}
+
+	n, l, base := it.t.root, it.t.rootLevel, uint64(0)
+
+	for {
+		in, ok := n.(*inode)
+
+		if !ok {
+			break
+		}
+
+		i := int((idx - base) >> l.shift)
+
+		it.path = append(it.path, iterFrame{in: in, l: l, i: i, base: base})
+
+		n, l, base = in.nodes[i], l.next, base+uint64(i)<<l.shift
+	}
+
+	switch n := n.(type) {
+	case *clrnode:
+		// no set bits here
+
+	case *setnode:
+		return it.at(n, l, base, idx)
+
+	default: // leaf, of any kind
+
+		if i, found := n.nextset(l, idx-base, l.max); found {
+			return it.at(n, l, base, base+i)
+		}
+	}
+
+	return it.ascendNext()
+}
+
+// Next moves the iterator to the next set bit, returning it
+func (it *Iterator) Next() (uint64, bool) {
+
+	switch it.state {
+	case iterReset, iterBefore:
+		return it.descendFirst(it.t.root, it.t.rootLevel, 0)
+
+	case iterAfter:
+		return 0, false
+	}
+
+	if off := it.idx - it.base; off < it.nl.max {
+
+		switch n := it.node.(type) {
+		case *setnode:
+			it.idx++
+			return it.idx, true
+
+		default: // leaf, of any kind
+
+			if i, found := n.nextset(it.nl, off+1, it.nl.max); found {
+				it.idx = it.base + i
+				return it.idx, true
+			}
+		}
+	}
+
+	return it.ascendNext()
+}
+
+// Prev moves the iterator to the previous set bit, returning it
+func (it *Iterator) Prev() (uint64, bool) {
+
+	switch it.state {
+	case iterReset, iterAfter:
+		return it.descendLast(it.t.root, it.t.rootLevel, 0)
+
+	case iterBefore:
+		return 0, false
+	}
+
+	if off := it.idx - it.base; off > 0 {
+
+		switch n := it.node.(type) {
+		case *setnode:
+			it.idx--
+			return it.idx, true
+
+		default: // leaf, of any kind
+
+			if i, found := n.prevset(it.nl, off-1); found {
+				it.idx = it.base + i
+				return it.idx, true
+			}
+		}
+	}
+
+	return it.ascendPrev()
+}
+
+// at positions the iterator at idx, within the node n
+func (it *Iterator) at(n node, l *level, base, idx uint64) (uint64, bool) {
+
+	it.node, it.nl, it.base, it.idx = n, l, base, idx
+	it.state = iterAt
+
+	return idx, true
+}
+
+// ascendNext pops the path up to the first inode with a later child that
+// has set bits, and descends to the first set bit in it
+func (it *Iterator) ascendNext() (uint64, bool) {
+
+	for len(it.path) > 0 {
+
+		f := &it.path[len(it.path)-1]
+
+		for f.i++; f.i < f.l.total; f.i++ {
+
+			if next := f.in.nodes[f.i]; !isClr(next) {
+				return it.descendFirst(next, f.l.next, f.base+uint64(f.i)<<f.l.shift)
+			}
+		}
+
+		it.path = it.path[:len(it.path)-1]
+	}
+
+	it.Reset()
+	it.state = iterAfter
+
+	return 0, false
+}
+
+// ascendPrev is ascendNext, in the other direction
+func (it *Iterator) ascendPrev() (uint64, bool) {
+
+	for len(it.path) > 0 {
+
+		f := &it.path[len(it.path)-1]
+
+		for f.i--; f.i >= 0; f.i-- {
+
+			if next := f.in.nodes[f.i]; !isClr(next) {
+				return it.descendLast(next, f.l.next, f.base+uint64(f.i)<<f.l.shift)
+			}
+		}
+
+		it.path = it.path[:len(it.path)-1]
+	}
+
+	it.Reset()
+	it.state = iterBefore
+
+	return 0, false
+}
+
+// descendFirst positions the iterator at the first set bit under n; inodes
+// and leaves should never be all-clr, but one that is (or a clrnode) is
+// skipped, continuing with the nodes after it
+func (it *Iterator) descendFirst(n node, l *level, base uint64) (uint64, bool) {
+
+	for {
+		switch nn := n.(type) {
+		case *clrnode:
+			return it.ascendNext()
+
+		case *setnode:
+			return it.at(nn, l, base, base)
+
+		case *inode:
+
+			i := 0
+
+			for i < l.total && isClr(nn.nodes[i]) {
+				i++
+			}
+
+			if i == l.total {
+				return it.ascendNext()
+			}
+
+			it.path = append(it.path, iterFrame{in: nn, l: l, i: i, base: base})
+
+			n, l, base = nn.nodes[i], l.next, base+uint64(i)<<l.shift
+
+		default: // leaf, of any kind
+			if i, found := nn.nextset(l, 0, l.max); found {
+				return it.at(nn, l, base, base+i)
+			}
+
+			return it.ascendNext()
+		}
+	}
+}
+
+// descendLast is descendFirst, for the last set bit under n
+func (it *Iterator) descendLast(n node, l *level, base uint64) (uint64, bool) {
+
+	for {
+		switch nn := n.(type) {
+		case *clrnode:
+			return it.ascendPrev()
+
+		case *setnode:
+			return it.at(nn, l, base, base+l.max)
+
+		case *inode:
+
+			i := l.total - 1
+
+			for i >= 0 && isClr(nn.nodes[i]) {
+				i--
+			}
+
+			if i < 0 {
+				return it.ascendPrev()
+			}
+
+			it.path = append(it.path, iterFrame{in: nn, l: l, i: i, base: base})
+
+			n, l, base = nn.nodes[i], l.next, base+uint64(i)<<l.shift
+
+		default: // leaf, of any kind
+			if i, found := nn.prevset(l, l.max); found {
+				return it.at(nn, l, base, base+i)
+			}
+
+			return it.ascendPrev()
+		}
+	}
+}
+
+func isClr(n node) bool {
+
+	_, ok := n.(*clrnode)
+	return ok
+}
@@ -0,0 +1,243 @@
+package bitset
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+type (
+	// LayoutHint biases the choice of level layout made by ChooseLayout
+	LayoutHint int
+
+	// Layout is a level layout chosen by ChooseLayout, along with a human
+	// readable explanation of why it was chosen
+	Layout struct {
+		LevelBits []uint
+		Reason    string
+
+		EstimatedBytes float64 // estimated memory used by the nodes
+	}
+)
+
+const (
+	// HintBalanced trades off memory use against the depth of the tree
+	HintBalanced LayoutHint = iota
+
+	// HintMemory picks the layout with the smallest estimated memory use
+	HintMemory
+
+	// HintSpeed strongly prefers fewer levels to descend
+	HintSpeed
+)
+
+const (
+	// leaves hold at least a full word, and at most 8KB of bits
+	minLeafBits = 6
+	maxLeafBits = 16
+
+	// inodes have 16 to 4K children (narrower inodes would save a little
+	// more memory on very sparse data, at the cost of a much deeper tree)
+	minFanoutBits = 4
+	maxFanoutBits = 12
+
+	// approximate size of the node structs (excluding their slices)
+	leafBytes      = 40
+	arrayLeafBytes = 32
+	runLeafBytes   = 40
+	inodeBytes     = 48
+	childBytes     = 16 // an interface value in inode.nodes
+)
+
+func (h LayoutHint) String() string {
+
+	switch h {
+	case HintBalanced:
+		return "balanced"
+
+	case HintMemory:
+		return "memory"
+
+	case HintSpeed:
+		return "speed"
+	}
+
+	return fmt.Sprintf("LayoutHint(%d)", int(h))
+}
+
+func (l Layout) String() string {
+	return fmt.Sprintf("%v: %s", l.LevelBits, l.Reason)
+}
+
+// ChooseLayout picks a level layout (leaf level first) for a bitset that
+// needs to hold indexes up to maxIdx, with about expectedSetBits set.
+//
+// Candidate layouts (leaves of 2^6 to 2^16 bits, with the remaining bits
+// spread evenly over inode levels of 2^4 to 2^12 children) are scored by the
+// memory their materialized nodes are expected to use, assuming the set bits
+// are spread uniformly; a node is materialized only when it has a mix of set
+// and clear bits, so dense data favors wide leaves and sparse data narrow
+// ones (or the array leaves of 2^8 to 2^16 bit leaves, see pack). The hint weighs the memory against the number of levels:
+// HintMemory uses memory alone, HintBalanced memory x levels and HintSpeed
+// memory x levels^2.
+func ChooseLayout(maxIdx, expectedSetBits uint64, hint LayoutHint) Layout {
+
+	total := uint(bits.Len64(maxIdx))
+
+	if total == 0 {
+		total = 1 // at least one bit, to hold index 0
+	}
+
+	if expectedSetBits == 0 {
+		expectedSetBits = 1
+	}
+
+	// fraction of bits expected to be set
+	density := float64(expectedSetBits) / (float64(maxIdx) + 1)
+
+	if density > 1 {
+		density = 1
+	}
+
+	var best Layout
+	var bestScore float64
+
+	for leafBits := minLeafBits; leafBits <= maxLeafBits; leafBits++ {
+
+		levelBits := []uint{uint(leafBits)}
+
+		if levelBits[0] >= total {
+			levelBits[0] = total
+		}
+
+		for fanout := uint(minFanoutBits); fanout <= maxFanoutBits; fanout++ {
+
+			layout := spreadLevels(levelBits, total, fanout)
+
+			bytes := estimateBytes(layout, density)
+			score := bytes * math.Pow(float64(len(layout)), float64(hint.depthWeight()))
+
+			// on a tie, prefer fewer levels
+			if best.LevelBits == nil || score < bestScore ||
+				(score == bestScore && len(layout) < len(best.LevelBits)) {
+
+				best = Layout{LevelBits: layout, EstimatedBytes: bytes}
+				bestScore = score
+			}
+
+			if levelBits[0] == total {
+				break // single level, no inodes
+			}
+		}
+
+		if levelBits[0] == total {
+			break // wider leaves would be the same layout
+		}
+	}
+
+	best.Reason = fmt.Sprintf("%d index bits at density %.3g: "+
+		"estimated %.0f bytes over %d level(s), lowest for %v",
+		total, density, best.EstimatedBytes, len(best.LevelBits), hint)
+
+	return best
+}
+
+// depthWeight returns the exponent applied to the number of levels, when
+// scoring a layout for the hint
+func (h LayoutHint) depthWeight() int {
+
+	switch h {
+	case HintMemory:
+		return 0
+
+	case HintSpeed:
+		return 2
+	}
+
+	return 1
+}
+
+// spreadLevels returns the leaf level followed by the fewest inode levels
+// (of at most 2^fanout children) needed to make up 'total' bits, with the
+// bits spread evenly (and any remainder handed to the upper levels)
+func spreadLevels(leaf []uint, total, fanout uint) []uint {
+
+	levelBits := append([]uint(nil), leaf...)
+
+	rest := total - leaf[0]
+
+	if rest == 0 {
+		return levelBits
+	}
+
+	n := (rest + fanout - 1) / fanout
+
+	for i := uint(0); i < n; i++ {
+		levelBits = append(levelBits, rest/n)
+	}
+
+	for i := uint(0); i < rest%n; i++ {
+		levelBits[len(levelBits)-1-int(i)]++
+	}
+
+	return levelBits
+}
+
+// estimateBytes returns the expected memory used by the nodes of a bitset
+// with the given layout, when each bit is set with the given probability;
+// a node spanning 2^s bits is materialized unless all of them are clear,
+// with probability (1-d)^(2^s), or all of them are set, with d^(2^s)
+func estimateBytes(levelBits []uint, density float64) (bytes float64) {
+
+	var total uint
+
+	for _, b := range levelBits {
+		total += b
+	}
+
+	var span uint // bits spanned by a node at the level
+
+	for i, b := range levelBits {
+
+		span += b
+
+		size := math.Ldexp(1, int(span)) // bits in a node
+		nodes := math.Ldexp(1, int(total-span))
+
+		mixed := 1 - math.Exp(size*math.Log1p(-density)) - math.Exp(size*math.Log(density))
+
+		if i == 0 {
+			bytes += nodes * mixed * estimateLeafBytes(b, size, density, mixed)
+		} else {
+			bytes += nodes * mixed * (inodeBytes + childBytes*math.Ldexp(1, int(b)))
+		}
+	}
+
+	return bytes
+}
+
+// estimateLeafBytes returns the expected memory used by a materialized leaf
+// spanning 'size' (2^b) bits, of the kind that holds its expected number of
+// set bits, and of runs of them, in the least memory (see leafKind); 'mixed'
+// is the probability of the leaf being materialized
+func estimateLeafBytes(b uint, size, density, mixed float64) float64 {
+
+	bitmap := leafBytes + 8*math.Ceil(size/64)
+
+	if b < minAdaptiveLeafBits || b > maxAdaptiveLeafBits || mixed <= 0 {
+		return bitmap
+	}
+
+	// the bits set in a leaf that's neither all-clr nor all-set; each starts
+	// a run if the bit before it is clear
+	set := (size*density - size*math.Exp(size*math.Log(density))) / mixed
+	runs := set * (1 - density)
+
+	return min(bitmap, arrayLeafBytes+2*set, runLeafBytes+4*runs)
+}
+
+// NewForCapacity returns a new bitset using the layout picked by ChooseLayout
+// for the given capacity and expected number of set bits
+func NewForCapacity(maxIdx, expectedSetBits uint64, hint LayoutHint) (Bitset, error) {
+	return NewWithError(ChooseLayout(maxIdx, expectedSetBits, hint).LevelBits)
+}
@@ -3,6 +3,7 @@ package bitset
 import (
 	"fmt"
 	"math"
+	"math/bits"
 )
 
 const (
@@ -12,7 +13,7 @@ const (
 
 type (
 	leaf struct {
-		level  *level   // level context
+		owner  *owner   // owner of the node (see level.owns)
 		numSet int      // number of bits that are set
 		bits   []uint64 // bit slice of 64-bit integers
 	}
@@ -26,8 +27,13 @@ func newLeafSet(l *level) *leaf {
 		bits[i] = allSetBits
 	}
 
+	// keep the bits beyond the size of the leaf clear
+	if r := l.total % 64; r != 0 {
+		bits[len(bits)-1] = allSetBits >> uint(64-r)
+	}
+
 	return &leaf{
-		level:  l,
+		owner:  l.token(),
 		numSet: l.total,
 		bits:   bits,
 	}
@@ -42,7 +48,7 @@ func newLeafClr(l *level) *leaf {
 	}
 
 	return &leaf{
-		level:  l,
+		owner:  l.token(),
 		numSet: 0,
 		bits:   bits,
 	}
@@ -63,6 +69,8 @@ func (n *leaf) set(l *level, idx uint64) (set bool, replace node) {
 		return false, n
 	}
 
+	n = n.own(l) // copy-on-write, if shared
+
 	n.bits[bindex] |= bmask // set the bit
 
 	if n.numSet++; n.numSet == l.total {
@@ -81,137 +89,175 @@ func (n *leaf) clr(l *level, idx uint64) (cleared bool, replace node) {
 		return false, n
 	}
 
+	n = n.own(l) // copy-on-write, if shared
+
 	n.bits[bindex] &= ^bmask // clear the bit
 
 	if n.numSet--; n.numSet == 0 {
 		return true, sparsify(l, n, false)
 	}
 
+	// switch to an array leaf well below arrayMax, so that a leaf hovering
+	// around it is not converted back and forth
+	if l.adaptive && n.numSet <= arrayMax(l)/2 {
+		return true, pack(l, n)
+	}
+
 	return true, n
 }
 
-func (n *leaf) nextset(l *level, start uint64) (idx uint64, found bool) {
+func (n *leaf) setrange(l *level, start, end uint64) (changed uint64, replace node) {
 
-	i := int(start)
-	bindex, bmask := (i / 64), uint64(1)<<(uint(i)%64)
+	for i := start; i <= end; i = (i | 63) + 1 {
 
-find:
-	for i < l.total {
+		bindex, bmask := int(i/64), wordMask(i, end)
 
-		switch n.bits[bindex] {
+		if c := bits.OnesCount64(bmask &^ n.bits[bindex]); c != 0 {
 
-		case allSetBits:
-			return uint64(i), true
+			n = n.own(l) // copy-on-write, if shared
 
-		case allClearBits:
-			// skip over to next uint64
-			bindex++
-			bmask = 1
-			i += 64 - (i % 64)
-			continue find
+			changed += uint64(c)
+			n.bits[bindex] |= bmask // set the bits
+		}
+	}
 
-		default:
+	if n.numSet += int(changed); n.numSet == l.total {
+		return changed, sparsify(l, n, true)
+	}
 
-			if n.bits[bindex]&bmask != 0 {
-				return uint64(i), true
-			}
+	// a range changes the bits wholesale, so (unlike a single bit) it may
+	// leave them held best by another kind of leaf, such as a few long runs
+	if l.adaptive && changed != 0 {
+		return changed, pack(l, n)
+	}
 
-			// move to the next bit
-			if i++; i%64 == 0 {
-				bindex++
-				bmask = 1
-			} else {
-				bmask <<= 1
-			}
+	return changed, n
+}
+
+func (n *leaf) clrrange(l *level, start, end uint64) (changed uint64, replace node) {
+
+	for i := start; i <= end; i = (i | 63) + 1 {
 
-			continue find
+		bindex, bmask := int(i/64), wordMask(i, end)
+
+		if c := bits.OnesCount64(bmask & n.bits[bindex]); c != 0 {
+
+			n = n.own(l) // copy-on-write, if shared
+
+			changed += uint64(c)
+			n.bits[bindex] &= ^bmask // clear the bits
 		}
 	}
 
-	return math.MaxUint64, false
+	if n.numSet -= int(changed); n.numSet == 0 {
+		return changed, sparsify(l, n, false)
+	}
+
+	if l.adaptive && changed != 0 {
+		return changed, pack(l, n) // see setrange
+	}
+
+	return changed, n
 }
 
-func (n *leaf) prevset(l *level, start uint64) (idx uint64, found bool) {
+func (n *leaf) fliprange(l *level, start, end uint64) (set, cleared uint64, replace node) {
 
-	if start >= uint64(l.total) {
-		start = uint64(l.total - 1)
+	n = n.own(l) // copy-on-write, if shared
+
+	for i := start; i <= end; i = (i | 63) + 1 {
+
+		bindex, bmask := int(i/64), wordMask(i, end)
+
+		c := uint64(bits.OnesCount64(bmask & n.bits[bindex]))
+		set, cleared = set+uint64(bits.OnesCount64(bmask))-c, cleared+c
+
+		n.bits[bindex] ^= bmask // flip the bits
 	}
 
-	i := int(start)
+	switch n.numSet += int(set) - int(cleared); n.numSet {
+	case l.total:
+		return set, cleared, sparsify(l, n, true)
 
-	bindex, bmask := (i / 64), uint64(1)<<(uint(i)%64)
+	case 0:
+		return set, cleared, sparsify(l, n, false)
+	}
 
-find:
-	for i >= 0 {
+	if l.adaptive {
+		return set, cleared, pack(l, n) // see setrange
+	}
 
-		switch n.bits[bindex] {
+	return set, cleared, n
+}
 
-		case allSetBits:
-			return uint64(i), true
+func (n *leaf) count(l *level) (set uint64) {
+	return uint64(n.numSet)
+}
 
-		case allClearBits:
-			// skip over to prev uint64
-			bindex--
-			bmask = 1 << 63
-			i -= 1 + (i % 64)
+// own returns the leaf itself if it's owned by the tree of level l (see
+// level.owns); otherwise the leaf is shared with a clone, and a copy of it is
+// returned to be modified
+func (n *leaf) own(l *level) *leaf {
 
-			continue find
+	if l.owns(n.owner) {
+		return n
+	}
 
-		default:
-			if n.bits[bindex]&bmask != 0 {
-				return uint64(i), true
-			}
+	return &leaf{
+		owner:  l.token(),
+		numSet: n.numSet,
+		bits:   append([]uint64(nil), n.bits...),
+	}
+}
 
-			// move to the prev bit
-			if i--; i%64 == 63 {
-				bindex--
-				bmask = 1 << 63
-			} else {
-				bmask >>= 1
-			}
+// wordMask returns the mask of bits in [start, end] that fall within the
+// uint64 word containing 'start'
+func wordMask(start, end uint64) uint64 {
 
-			continue find
-		}
+	mask := uint64(allSetBits) << (start % 64)
+
+	if end/64 == start/64 {
+		mask &= allSetBits >> (63 - end%64)
 	}
 
-	return 0, false
+	return mask
 }
 
-func (n *leaf) nextclr(l *level, start uint64) (idx uint64, found bool) {
+// nextset returns the first set bit in [start, end], masking the words at
+// either end of the range and scanning a word at a time
+func (n *leaf) nextset(l *level, start, end uint64) (idx uint64, found bool) {
 
-	i := int(start)
-	bindex, bmask := (i / 64), uint64(1)<<(uint(i)%64)
+	for i := start; i <= end; i = (i | 63) + 1 {
 
-find:
-	for i < l.total {
+		if w := n.bits[i/64] & wordMask(i, end); w != 0 {
+			return (i &^ 63) + uint64(bits.TrailingZeros64(w)), true
+		}
+	}
 
-		switch n.bits[bindex] {
+	return math.MaxUint64, false
+}
 
-		case allClearBits:
-			return uint64(i), true
+func (n *leaf) prevset(l *level, start uint64) (idx uint64, found bool) {
 
-		case allSetBits:
-			// skip over to next uint64
-			bindex++
-			bmask = 1
-			i += 64 - (i % 64)
-			continue find
+	if start >= uint64(l.total) {
+		start = uint64(l.total - 1)
+	}
 
-		default:
+	for i := int(start); i >= 0; i = (i &^ 63) - 1 {
 
-			if n.bits[bindex]&bmask == 0 {
-				return uint64(i), true
-			}
+		if w := n.bits[i/64] & prevMask(uint(i)); w != 0 {
+			return uint64(i&^63 + 63 - bits.LeadingZeros64(w)), true
+		}
+	}
 
-			// move to the next bit
-			if i++; i%64 == 0 {
-				bindex++
-				bmask = 1
-			} else {
-				bmask <<= 1
-			}
+	return 0, false
+}
 
-			continue find
+func (n *leaf) nextclr(l *level, start, end uint64) (idx uint64, found bool) {
+
+	for i := start; i <= end; i = (i | 63) + 1 {
+
+		if w := ^n.bits[i/64] & wordMask(i, end); w != 0 {
+			return (i &^ 63) + uint64(bits.TrailingZeros64(w)), true
 		}
 	}
 
@@ -224,48 +270,57 @@ func (n *leaf) prevclr(l *level, start uint64) (idx uint64, found bool) {
 		start = uint64(l.total - 1)
 	}
 
-	i := int(start)
-
-	bindex, bmask := (i / 64), uint64(1)<<(uint(i)%64)
+	for i := int(start); i >= 0; i = (i &^ 63) - 1 {
 
-find:
-	for i >= 0 {
-
-		switch n.bits[bindex] {
+		if w := ^n.bits[i/64] & prevMask(uint(i)); w != 0 {
+			return uint64(i&^63 + 63 - bits.LeadingZeros64(w)), true
+		}
+	}
 
-		case allClearBits:
-			return uint64(i), true
+	return 0, false
+}
 
-		case allSetBits:
-			// skip over to next uint64
-			bindex--
-			bmask = 1 << 63
-			i -= 1 + (i % 64)
+// nthset returns the index of the n-th set bit (counting from 0), skipping
+// over whole words by their popcount
+func (n *leaf) nthset(l *level, nth uint64) (idx uint64) {
 
-			continue find
+	for i, w := range n.bits {
 
-		default:
+		c := uint64(bits.OnesCount64(w))
 
-			if n.bits[bindex]&bmask == 0 {
-				return uint64(i), true
-			}
+		if nth < c {
 
-			// move to the next bit
-			if i--; i%64 == 63 {
-				bindex--
-				bmask = 1 << 63
-			} else {
-				bmask >>= 1
+			// clear the lower set bits in the word
+			for ; nth > 0; nth-- {
+				w &= w - 1
 			}
 
-			continue find
+			return uint64(i*64 + bits.TrailingZeros64(w))
 		}
+
+		nth -= c
 	}
 
-	return 0, false
+	return math.MaxUint64 // not reached
+}
+
+// prevMask returns the mask of bits up to (and including) 'start', within
+// the uint64 word containing it
+func prevMask(start uint) uint64 {
+	return allSetBits >> (63 - start%64)
+}
+
+// countrange returns the number of bits set in [start, end]
+func (n *leaf) countrange(l *level, start, end uint64) (set uint64) {
+
+	for i := start; i <= end; i = (i | 63) + 1 {
+		set += uint64(bits.OnesCount64(n.bits[i/64] & wordMask(i, end)))
+	}
+
+	return set
 }
 
 func (n *leaf) String() string {
-	return fmt.Sprintf("leaf(%p): level=%p numSet=%d bits=%v",
-		n, n.level, n.numSet, n.bits)
+	return fmt.Sprintf("leaf(%p): owner=%p numSet=%d bits=%v",
+		n, n.owner, n.numSet, n.bits)
 }
@@ -2,7 +2,8 @@ package bitset
 
 import (
 	"fmt"
-	"math"
+	"strconv"
+	"sync/atomic"
 )
 
 type (
@@ -13,30 +14,58 @@ type (
 		total int    // number of child inodes/leaf-bits
 		mask  uint64 // mask to compute node index
 		next  *level // lower level
+		max   uint64 // max index within a node at this level
+
+		adaptive bool // leaf level with array/run leaves (see pack)
+
+		owner *owner // owner of the nodes created at this level (see owns)
 
 		numNodes int // #stats
 
 		height int  // level
 		bits   uint // number of bits in 'address'
 	}
+
+	// owner is the token by which a tree owns the nodes it created; cloning
+	// the tree marks the token shared (rather than modifying the tree, which
+	// may be read concurrently), and the tree moves on to a new token when
+	// it next creates a node
+	owner struct {
+		shared atomic.Bool
+	}
 )
 
-func initLevels(levelBits []uint) (rootLevel *level, maxIdx uint64) {
+func initLevels(levelBits []uint) (rootLevel *level, maxIdx uint64, err error) {
 
 	// must at least include spec for leaf node
 	if len(levelBits) == 0 {
-		return nil, 0
+		return nil, 0, ErrEmptyLayout
 	}
 
 	// leaf node should have non-zero allocation
 	if levelBits[0] == 0 {
-		return nil, 0
+		return nil, 0, ErrEmptyLeaf
 	}
 
-	levels := make([]*level, len(levelBits))
 	var shift uint
+
+	// the index must fit in 64 bits, and the node fan-out in an int
+	for _, n := range levelBits {
+
+		if shift += n; shift > 64 {
+			return nil, 0, ErrTooManyBits
+		}
+
+		if n >= strconv.IntSize-1 {
+			return nil, 0, ErrLevelTooWide
+		}
+	}
+
+	levels := make([]*level, len(levelBits))
 	var next *level
 
+	shift = 0
+
 	// compute and initialize level definitions
 	for i, n := range levelBits {
 
@@ -44,9 +73,14 @@ func initLevels(levelBits []uint) (rootLevel *level, maxIdx uint64) {
 			shift: shift,
 			mask:  (uint64(1) << shift) - 1,
 			total: 1 << n,
+			max:   (uint64(1) << (shift + n)) - 1,
 			next:  next,
 			leaf:  i == 0,
 
+			adaptive: i == 0 && n >= minAdaptiveLeafBits && n <= maxAdaptiveLeafBits,
+
+			owner: &owner{},
+
 			height: i,
 			bits:   n,
 
@@ -57,16 +91,68 @@ func initLevels(levelBits []uint) (rootLevel *level, maxIdx uint64) {
 		shift += n
 	}
 
-	if shift > 64 {
-		return nil, math.MaxInt64
-	}
-
 	rootLevel = levels[len(levelBits)-1]
 	maxIdx = (uint64(1) << shift) - 1
 
 	return
 }
 
+// cloneLevels returns a copy of the level hierarchy (including the #stats),
+// with new owners; the nodes of the tree are not owned by the copy, so they
+// are copied (see own) when the tree of the copy first modifies them
+func cloneLevels(l *level) *level {
+
+	if l == nil {
+		return nil
+	}
+
+	c := *l
+	c.owner = &owner{}
+	c.next = cloneLevels(l.next)
+
+	return &c
+}
+
+// owns returns true if a node with the given owner was created by the tree
+// of the level since it was last cloned, so it can be modified in place
+func (l *level) owns(o *owner) bool {
+	return o == l.owner && !o.shared.Load()
+}
+
+// token returns the owner of the nodes created at the level, moving on to a
+// new one if the current one is shared with a clone
+func (l *level) token() *owner {
+
+	if l.owner.shared.Load() {
+		l.owner = &owner{}
+	}
+
+	return l.owner
+}
+
+// share marks the nodes of the tree under the level as shared with a clone;
+// only the (atomic) flag of the owners is modified, not the levels or nodes
+func (l *level) share() {
+
+	for ; l != nil; l = l.next {
+		l.owner.shared.Store(true)
+	}
+}
+
+// sameLayout returns true if the two level hierarchies have the same bits
+// allocated at every level (ie, nodes from one can be merged into the other)
+func sameLayout(a, b *level) bool {
+
+	for ; a != nil && b != nil; a, b = a.next, b.next {
+
+		if a.bits != b.bits {
+			return false
+		}
+	}
+
+	return a == nil && b == nil
+}
+
 func (t *level) String() string {
 	return fmt.Sprintf("level(%p): h=%d bits=%d leaf=%v mask=%d shift=%d next=%p",
 		t, t.height, t.bits, t.leaf, t.mask, t.shift, t.next)
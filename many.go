@@ -0,0 +1,204 @@
+package bitset
+
+import (
+	"slices"
+	"sort"
+)
+
+// sortedIdxs returns the indexes in ascending order (sorting a copy, if
+// they're not), without those beyond max
+func sortedIdxs(idxs []uint64, max uint64) []uint64 {
+
+	if !slices.IsSorted(idxs) {
+		idxs = slices.Clone(idxs)
+		slices.Sort(idxs)
+	}
+
+	return idxs[:sort.Search(len(idxs), func(i int) bool { return idxs[i] > max })]
+}
+
+// SetMany sets the bits at the given indexes (ignoring those beyond Max()),
+// visiting each subtree once; returns the number of bits that were changed.
+// The indexes may be in any order, but unsorted ones are first sorted (in a
+// copy), which can cost more than is saved on the descents.
+func (t *bitset) SetMany(idxs []uint64) (changed uint64) {
+	return t.many(sortedIdxs(idxs, t.max), true)
+}
+
+// ClearMany is SetMany, for clearing the bits
+func (t *bitset) ClearMany(idxs []uint64) (changed uint64) {
+	return t.many(sortedIdxs(idxs, t.max), false)
+}
+
+// many sets/clears the bits at the sorted indexes
+func (t *bitset) many(idxs []uint64, set bool) (changed uint64) {
+
+	if len(idxs) == 0 {
+		return 0
+	}
+
+	changed, replace := many(t.rootLevel, t.root, 0, idxs, set)
+
+	if set {
+		t.count += changed
+	} else {
+		t.count -= changed
+	}
+
+	if replace != t.root {
+		t.root = replace
+	}
+
+	t.debugValidate()
+
+	return changed
+}
+
+// many sets/clears the bits at the sorted indexes, all within the node n at
+// level l, starting at base; the indexes are grouped by the child they fall
+// in, so each child is visited once, and replaced (see node.set) once
+func many(l *level, n node, base uint64, idxs []uint64, set bool) (changed uint64, replace node) {
+
+	_, isSet := n.(*setnode)
+	_, isClr := n.(*clrnode)
+
+	if isSet && set || isClr && !set {
+		return 0, n // nothing to change
+	}
+
+	// desparsify a sparse node above the leaves, to change the bits under it
+	if (isSet || isClr) && !l.leaf {
+		n = desparsify(l, n, isSet)
+	}
+
+	in, ok := n.(*inode)
+
+	if !ok {
+
+		// a leaf of any kind (or a sparse node in its place): the bits are
+		// set/cleared one at a time, as the node is replaced along the way
+		for _, idx := range idxs {
+
+			var c bool
+
+			if set {
+				c, n = n.set(l, idx-base)
+			} else {
+				c, n = n.clr(l, idx-base)
+			}
+
+			if c {
+				changed++
+			}
+		}
+
+		return changed, n
+	}
+
+	for len(idxs) > 0 {
+
+		i := int((idxs[0] - base) >> l.shift)
+		cbase := base + uint64(i)<<l.shift
+
+		// the indexes in the child
+		j := 1
+
+		for j < len(idxs) && idxs[j]-cbase <= l.mask {
+			j++
+		}
+
+		next := in.nodes[i]
+		c, repl := many(l.next, next, cbase, idxs[:j], set)
+
+		if c != 0 || repl != next {
+
+			in = in.own(l) // copy-on-write, if shared
+
+			if set {
+				in.numSet += c
+			} else {
+				in.numSet -= c
+			}
+
+			if repl != next {
+				in.replace(i, repl)
+			}
+		}
+
+		changed += c
+		idxs = idxs[j:]
+	}
+
+	return changed, in.compact(l)
+}
+
+// TestMany tests the bits at the given indexes (in any order), visiting each
+// subtree once, setting out[i] to whether the bit at idxs[i] is set; out must
+// be at least as long as idxs
+func (t *bitset) TestMany(idxs []uint64, out []bool) {
+
+	out = out[:len(idxs)]
+
+	if slices.IsSorted(idxs) {
+		testMany(t.rootLevel, t.root, 0, idxs, out, t.max)
+		return
+	}
+
+	// test in order, and scatter the results back
+	order := make([]int, len(idxs))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.Slice(order, func(a, b int) bool { return idxs[order[a]] < idxs[order[b]] })
+
+	sorted, res := make([]uint64, len(idxs)), make([]bool, len(idxs))
+
+	for i, o := range order {
+		sorted[i] = idxs[o]
+	}
+
+	testMany(t.rootLevel, t.root, 0, sorted, res, t.max)
+
+	for i, o := range order {
+		out[o] = res[i]
+	}
+}
+
+// testMany tests the bits at the sorted indexes, all within the node n at
+// level l, starting at base (except for those beyond max, which are clear)
+func testMany(l *level, n node, base uint64, idxs []uint64, out []bool, max uint64) {
+
+	in, ok := n.(*inode)
+
+	if !ok {
+
+		for i, idx := range idxs {
+			out[i] = idx <= max && n.test(l, idx-base)
+		}
+
+		return
+	}
+
+	for len(idxs) > 0 {
+
+		if idxs[0] > max {
+			clear(out)
+			return
+		}
+
+		i := int((idxs[0] - base) >> l.shift)
+		cbase := base + uint64(i)<<l.shift
+
+		j := 1
+
+		for j < len(idxs) && idxs[j]-cbase <= l.mask {
+			j++
+		}
+
+		testMany(l.next, in.nodes[i], cbase, idxs[:j], out[:j], max)
+
+		idxs, out = idxs[j:], out[j:]
+	}
+}
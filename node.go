@@ -1,19 +1,34 @@
 package bitset
 
+import (
+	"math/bits"
+)
+
 type (
 	// node is the interface that is implemented by the four types of nodes:
 	// - leaf (leaf node, actual storage for bits in []uint64)
+	// - arrayleaf/runleaf (leaf nodes holding offsets/runs, see pack)
 	// - inode (intermediate nodes in the tree)
 	// - setnode (sparse node that indicates everything under is "set")
 	// - clrnode (sparse node that indicates everything under is "clear")
+	//
+	// The counts of bits (changed, or set) are modulo 2^64, so those of a
+	// whole root node of 64 bits wrap to 0; the bitset tells an all-set tree
+	// from an empty one by its root (see bitset.full).
 	node interface {
 		test(l *level, idx uint64) (set bool)
 		set(l *level, idx uint64) (set bool, replace node)
 		clr(l *level, idx uint64) (cleared bool, replace node)
-		nextset(l *level, start uint64) (idx uint64, found bool)
-		nextclr(l *level, start uint64) (idx uint64, found bool)
+		setrange(l *level, start, end uint64) (changed uint64, replace node)
+		clrrange(l *level, start, end uint64) (changed uint64, replace node)
+		fliprange(l *level, start, end uint64) (set, cleared uint64, replace node)
+		nextset(l *level, start, end uint64) (idx uint64, found bool)
+		nextclr(l *level, start, end uint64) (idx uint64, found bool)
 		prevset(l *level, start uint64) (idx uint64, found bool)
 		prevclr(l *level, start uint64) (idx uint64, found bool)
+		count(l *level) (set uint64)
+		countrange(l *level, start, end uint64) (set uint64)
+		nthset(l *level, n uint64) (idx uint64)
 	}
 )
 
@@ -33,6 +48,18 @@ func newNode(l *level, sparse, set bool) (n node) {
 
 	if l.leaf {
 
+		// the bits of a leaf that was sparse are all the same, until the
+		// caller changes some: a run leaf holds them best when they're set,
+		// and an array leaf when they're clear
+		if l.adaptive {
+
+			if set {
+				return newRunLeafSet(l)
+			}
+
+			return newArrayLeaf(l)
+		}
+
 		if set {
 			return newLeafSet(l)
 		}
@@ -66,11 +93,85 @@ func delNode(l *level, n node) {
 			delNode(l.next, nx)
 		}
 
-	case *leaf:
+	case *leaf, *arrayleaf, *runleaf:
 		l.numNodes--
 	}
 }
 
+// returns a deep copy of the given node (with node-stats accounted against
+// the given level, which may belong to another bitset with the same layout)
+func copyNode(l *level, n node) node {
+
+	switch n := n.(type) {
+	case *inode:
+
+		l.numNodes++ // #stats
+
+		in := &inode{
+			owner:  l.token(),
+			nSet:   n.nSet,
+			nClr:   n.nClr,
+			numSet: n.numSet,
+			nodes:  make([]node, len(n.nodes)),
+		}
+
+		for i, nx := range n.nodes {
+			in.nodes[i] = copyNode(l.next, nx)
+		}
+
+		return in
+
+	case *leaf:
+
+		l.numNodes++ // #stats
+
+		return &leaf{
+			owner:  l.token(),
+			numSet: n.numSet,
+			bits:   append([]uint64(nil), n.bits...),
+		}
+
+	case *arrayleaf:
+
+		l.numNodes++ // #stats
+
+		return &arrayleaf{
+			owner:   l.token(),
+			offsets: append([]uint16(nil), n.offsets...),
+		}
+
+	case *runleaf:
+
+		l.numNodes++ // #stats
+
+		return &runleaf{
+			owner:  l.token(),
+			numSet: n.numSet,
+			runs:   append([]run(nil), n.runs...),
+		}
+	}
+
+	return n // sparse nodes have no state
+}
+
+// accounts for the given node (and the nodes under it) in the node-stats of
+// the given level, for a tree that was assembled from existing nodes
+func addNode(l *level, n node) {
+
+	switch n := n.(type) {
+	case *inode:
+
+		l.numNodes++ // #stats
+
+		for _, nx := range n.nodes {
+			addNode(l.next, nx)
+		}
+
+	case *leaf, *arrayleaf, *runleaf:
+		l.numNodes++ // #stats
+	}
+}
+
 // returns an allset/allclr sparse-node to replace given node
 func sparsify(l *level, n node, set bool) (replace node) {
 
@@ -84,3 +185,247 @@ func desparsify(l *level, n node, set bool) (replace node) {
 	delNode(l, n)
 	return newNode(l, false, set)
 }
+
+type (
+	// leafkind is one of the kinds of materialized leaves
+	leafkind int
+)
+
+const (
+	kindBitmap leafkind = iota
+	kindArray
+	kindRun
+)
+
+const (
+	// leaves of 2^8 to 2^16 bits switch between the kinds (offsets fit in
+	// a uint16, and narrower leaves are small enough as bitmaps)
+	minAdaptiveLeafBits = 8
+	maxAdaptiveLeafBits = 16
+)
+
+// leafKind returns the kind of leaf that holds the bits in the least memory,
+// given the number of bits set and the number of runs they form; a bitmap
+// leaf is preferred on a tie (for speed), then an array leaf
+func leafKind(l *level, numSet, numRuns int) leafkind {
+
+	if !l.adaptive {
+		return kindBitmap
+	}
+
+	kind, size := kindBitmap, 8*leafWords(l)
+
+	if s := 2 * numSet; s < size {
+		kind, size = kindArray, s
+	}
+
+	if s := 4 * numRuns; s < size {
+		kind = kindRun
+	}
+
+	return kind
+}
+
+// newBitmap returns a new all-clr bitmap leaf, whatever the kind of leaf
+// newNode would pick for the level
+func newBitmap(l *level) *leaf {
+
+	l.numNodes++ // #stats
+
+	return newLeafClr(l)
+}
+
+// leafBits returns the bits of a materialized leaf, of any kind, as words;
+// they must not be modified, since for a bitmap leaf they are its own bits
+func leafBits(l *level, n node) []uint64 {
+
+	switch n := n.(type) {
+	case *leaf:
+		return n.bits
+
+	case *arrayleaf:
+
+		bits := make([]uint64, leafWords(l))
+
+		for _, o := range n.offsets {
+			bits[o/64] |= 1 << (o % 64)
+		}
+
+		return bits
+
+	case *runleaf:
+
+		bits := make([]uint64, leafWords(l))
+
+		for _, r := range n.runs {
+			for i, end := uint64(r.start), uint64(r.last); i <= end; i = (i | 63) + 1 {
+				bits[i/64] |= wordMask(i, end)
+			}
+		}
+
+		return bits
+	}
+
+	return nil
+}
+
+type (
+	// wordReader reads the words of a materialized leaf, of any kind, in
+	// order; unlike leafBits, it doesn't allocate for an array/run leaf
+	wordReader struct {
+		n   node
+		i   uint64 // index of the first bit of the next word
+		pos int    // position of the next offset/run, in an array/run leaf
+	}
+)
+
+// next returns the next word of the leaf
+func (r *wordReader) next() (w uint64) {
+
+	end := r.i + 63
+
+	switch n := r.n.(type) {
+	case *leaf:
+		w = n.bits[r.i/64]
+
+	case *arrayleaf:
+
+		for ; r.pos < len(n.offsets) && uint64(n.offsets[r.pos]) <= end; r.pos++ {
+			w |= 1 << (n.offsets[r.pos] % 64)
+		}
+
+	case *runleaf:
+
+		for ; r.pos < len(n.runs) && uint64(n.runs[r.pos].start) <= end; r.pos++ {
+
+			w |= wordMask(max(uint64(n.runs[r.pos].start), r.i), uint64(n.runs[r.pos].last))
+
+			if uint64(n.runs[r.pos].last) > end {
+				break // the run goes on into the next word
+			}
+		}
+	}
+
+	r.i += 64
+
+	return w
+}
+
+// unpack returns a bitmap leaf with the bits of an array/run leaf, to
+// replace it with
+func unpack(l *level, n node) *leaf {
+
+	b := &leaf{
+		owner:  l.token(),
+		numSet: int(n.count(l)),
+		bits:   leafBits(l, n),
+	}
+
+	delNode(l, n)
+	l.numNodes++ // #stats
+
+	return b
+}
+
+// pack returns the kind of leaf (see leafKind) that holds the bits of the
+// bitmap leaf in the least memory, to replace it with (which may be itself,
+// or a sparse node, if the bits are all-set or all-clr)
+func pack(l *level, n *leaf) (replace node) {
+	return packWords(l, n, 0, len(n.bits)-1)
+}
+
+// packWords is pack, for a leaf whose set bits are all in words [lo, hi]
+func packWords(l *level, n *leaf, lo, hi int) (replace node) {
+
+	switch n.numSet {
+	case l.total:
+		return sparsify(l, n, true)
+
+	case 0:
+		return sparsify(l, n, false)
+	}
+
+	if !l.adaptive {
+		return n
+	}
+
+	// count the runs by their first bits: set bits whose previous bit is clear
+	var numRuns int
+	var prev uint64
+
+	for _, w := range n.bits[lo : hi+1] {
+		numRuns += bits.OnesCount64(w &^ (w<<1 | prev>>63))
+		prev = w
+	}
+
+	switch leafKind(l, n.numSet, numRuns) {
+	case kindArray:
+
+		a := &arrayleaf{owner: l.token(), offsets: make([]uint16, 0, n.numSet)}
+
+		for i := lo; i <= hi; i++ {
+			for w := n.bits[i]; w != 0; w &= w - 1 {
+				a.offsets = append(a.offsets, uint16(i*64+bits.TrailingZeros64(w)))
+			}
+		}
+
+		delNode(l, n)
+		l.numNodes++ // #stats
+
+		return a
+
+	case kindRun:
+
+		r := &runleaf{owner: l.token(), numSet: n.numSet, runs: make([]run, 0, numRuns)}
+
+		// the first and last bits of the runs in each word, taken in order
+		var cur run
+
+		for i := lo; i <= hi; i++ {
+
+			var prev, next uint64
+
+			if i > 0 {
+				prev = n.bits[i-1]
+			}
+
+			if i+1 < len(n.bits) {
+				next = n.bits[i+1]
+			}
+
+			w := n.bits[i]
+
+			starts := w &^ (w<<1 | prev>>63)
+			ends := w &^ (w>>1 | next<<63)
+
+			for starts|ends != 0 {
+
+				if s := bits.TrailingZeros64(starts); starts != 0 && s <= bits.TrailingZeros64(ends) {
+					cur.start = uint16(i*64 + s)
+					starts &= starts - 1
+				} else {
+					cur.last = uint16(i*64 + bits.TrailingZeros64(ends))
+					r.runs = append(r.runs, cur)
+					ends &= ends - 1
+				}
+			}
+		}
+
+		delNode(l, n)
+		l.numNodes++ // #stats
+
+		return r
+	}
+
+	return n
+}
+
+// repack packs the node, if it's a bitmap leaf
+func repack(l *level, n node) (replace node) {
+
+	if b, ok := n.(*leaf); ok {
+		return pack(l, b)
+	}
+
+	return n
+}
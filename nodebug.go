@@ -0,0 +1,6 @@
+//go:build !bitset_debug
+
+package bitset
+
+// debugValidate is a no-op, unless built with the 'bitset_debug' tag
+func (t *bitset) debugValidate() {}
@@ -0,0 +1,380 @@
+package bitset
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+var (
+	// ErrLayoutMismatch is returned when combining two bitsets whose levels
+	// were not created with the same 'levelBits'
+	ErrLayoutMismatch = errors.New("bitset: level layout mismatch")
+)
+
+type (
+	// op is a binary set operation, applied node by node
+	op int
+)
+
+const (
+	opAnd op = iota
+	opOr
+	opXor
+	opAndNot
+)
+
+// word applies the op to a pair of uint64 words
+func (o op) word(a, b uint64) uint64 {
+
+	switch o {
+	case opAnd:
+		return a & b
+
+	case opOr:
+		return a | b
+
+	case opXor:
+		return a ^ b
+
+	default: // opAndNot
+		return a &^ b
+	}
+}
+
+// merge applies the op to node 'a' (which is modified in place) and node 'b'
+// (which is left unmodified), returning the node that replaces 'a'; sparse
+// nodes on either side short-circuit the op for the whole subtree under them
+func merge(l *level, o op, a, b node) (replace node) {
+
+	switch b.(type) {
+	case *setnode:
+
+		switch o {
+		case opAnd:
+			return a
+
+		case opOr:
+			return sparsify(l, a, true)
+
+		case opXor:
+			_, _, replace = a.fliprange(l, 0, l.max)
+			return replace
+
+		default: // opAndNot
+			return sparsify(l, a, false)
+		}
+
+	case *clrnode:
+
+		if o == opAnd {
+			return sparsify(l, a, false)
+		}
+
+		return a // or, xor, andnot with all-clr -> no-op
+	}
+
+	switch a.(type) {
+	case *setnode:
+
+		switch o {
+		case opAnd:
+			return copyNode(l, b)
+
+		case opOr:
+			return a
+
+		default: // opXor, opAndNot
+			_, _, replace = copyNode(l, b).fliprange(l, 0, l.max)
+			return replace
+		}
+
+	case *clrnode:
+
+		if o == opOr || o == opXor {
+			return copyNode(l, b)
+		}
+
+		return a // and, andnot on all-clr -> no-op
+	}
+
+	// both nodes materialized: since both have the same layout, they are
+	// either both inodes or both leaves (though maybe of different kinds)
+	switch a := a.(type) {
+	case *inode:
+
+		bn := b.(*inode)
+
+		for i := range a.nodes {
+
+			next := a.nodes[i]
+
+			if repl := merge(l.next, o, next, bn.nodes[i]); repl != next {
+				a = a.own(l) // copy-on-write, if shared
+				a.replace(i, repl)
+			}
+		}
+
+		// NB: children that were modified in place are owned, and so is 'a'
+		if set := a.recount(l); set != a.numSet {
+			a = a.own(l)
+			a.numSet = set
+		}
+
+		return a.compact(l)
+
+	case *leaf:
+		return mergeLeaf(l, o, a.own(l), b) // copy-on-write, if shared
+
+	default: // array/run leaf
+		return mergeLeaf(l, o, unpack(l, a), b)
+	}
+}
+
+// mergeLeaf applies the op to the bitmap leaf 'a' (which is modified in
+// place) and leaf 'b' (of any kind), and packs the result
+func mergeLeaf(l *level, o op, a *leaf, b node) (replace node) {
+
+	br := wordReader{n: b}
+
+	a.numSet = 0
+
+	for i := range a.bits {
+		a.bits[i] = o.word(a.bits[i], br.next())
+		a.numSet += bits.OnesCount64(a.bits[i])
+	}
+
+	return pack(l, a)
+}
+
+// mergeCount returns the number of bits that would be set in the result of
+// applying the op to nodes 'a' and 'b', without modifying either of them; the
+// count is modulo 2^64, like those of the nodes (see applyCount)
+func mergeCount(l *level, o op, a, b node) (set uint64) {
+
+	switch a.(type) {
+	case *setnode:
+
+		switch o {
+		case opAnd:
+			return b.count(l)
+
+		case opOr:
+			return l.max + 1
+
+		default: // opXor, opAndNot
+			return l.max + 1 - b.count(l)
+		}
+
+	case *clrnode:
+
+		if o == opOr || o == opXor {
+			return b.count(l)
+		}
+
+		return 0 // and, andnot on all-clr
+	}
+
+	switch b.(type) {
+	case *setnode:
+
+		switch o {
+		case opAnd:
+			return a.count(l)
+
+		case opOr:
+			return l.max + 1
+
+		case opXor:
+			return l.max + 1 - a.count(l)
+
+		default: // opAndNot
+			return 0
+		}
+
+	case *clrnode:
+
+		if o == opAnd {
+			return 0
+		}
+
+		return a.count(l) // or, xor, andnot with all-clr
+	}
+
+	// both nodes materialized
+	switch a := a.(type) {
+	case *inode:
+
+		bn := b.(*inode)
+
+		for i, next := range a.nodes {
+			set += mergeCount(l.next, o, next, bn.nodes[i])
+		}
+
+	default: // leaf, of any kind
+
+		ar, br := wordReader{n: a}, wordReader{n: b}
+
+		for range leafWords(l) {
+			set += uint64(bits.OnesCount64(o.word(ar.next(), br.next())))
+		}
+	}
+
+	return set
+}
+
+type (
+	// snapshotter is implemented by the Bitset types that can provide a
+	// *bitset (with their current contents) to be merged
+	snapshotter interface {
+		snapshot() *bitset
+	}
+)
+
+func (t *bitset) snapshot() *bitset {
+	return t
+}
+
+// other returns the *bitset underlying 'b', if it can be merged into t
+func (t *bitset) other(b Bitset) (*bitset, error) {
+
+	s, ok := b.(snapshotter)
+
+	if !ok {
+		return nil, ErrLayoutMismatch
+	}
+
+	o := s.snapshot()
+
+	if !sameLayout(t.rootLevel, o.rootLevel) {
+		return nil, ErrLayoutMismatch
+	}
+
+	return o, nil
+}
+
+// apply merges 'b' into t, in place
+func (t *bitset) apply(o op, b Bitset) error {
+
+	ob, err := t.other(b)
+
+	if err != nil {
+		return err
+	}
+
+	t.mergeWith(o, ob)
+
+	return nil
+}
+
+// applyCopy merges 'b' into a clone of t, leaving t unmodified
+func (t *bitset) applyCopy(o op, b Bitset) (Bitset, error) {
+
+	ob, err := t.other(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := t.Clone().(*bitset)
+	c.mergeWith(o, ob)
+
+	return c, nil
+}
+
+// mergeWith merges 'ob' (which has the same layout) into t, in place, and
+// recomputes the count
+func (t *bitset) mergeWith(o op, ob *bitset) {
+
+	if replace := merge(t.rootLevel, o, t.root, ob.root); replace != t.root {
+		t.root = replace
+	}
+
+	t.count = t.root.count(t.rootLevel)
+
+	t.debugValidate()
+}
+
+// applyCount returns the count of bits in the result of merging 'b' into t,
+// without materializing the result
+func (t *bitset) applyCount(o op, b Bitset) (uint64, error) {
+
+	ob, err := t.other(b)
+
+	if err != nil {
+		return 0, err
+	}
+
+	set := mergeCount(t.rootLevel, o, t.root, ob.root)
+
+	// with a layout of 64 bits, a count of 0 (mod 2^64) is that of an empty
+	// or a full result, which the first bit tells apart; a full one saturates
+	// (see Count)
+	if set == 0 && t.max == math.MaxUint64 && o.word(bit(t.Test(0)), bit(ob.Test(0))) != 0 {
+		return math.MaxUint64, nil
+	}
+
+	return set, nil
+}
+
+// bit returns the bool as a word, with only its first bit
+func bit(b bool) uint64 {
+
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+func (t *bitset) And(b Bitset) (Bitset, error) {
+	return t.applyCopy(opAnd, b)
+}
+
+func (t *bitset) Or(b Bitset) (Bitset, error) {
+	return t.applyCopy(opOr, b)
+}
+
+func (t *bitset) Xor(b Bitset) (Bitset, error) {
+	return t.applyCopy(opXor, b)
+}
+
+func (t *bitset) AndNot(b Bitset) (Bitset, error) {
+	return t.applyCopy(opAndNot, b)
+}
+
+func (t *bitset) Not() Bitset {
+	return t.Clone().FlipRange(0, t.max)
+}
+
+func (t *bitset) InPlaceAnd(b Bitset) error {
+	return t.apply(opAnd, b)
+}
+
+func (t *bitset) InPlaceOr(b Bitset) error {
+	return t.apply(opOr, b)
+}
+
+func (t *bitset) InPlaceXor(b Bitset) error {
+	return t.apply(opXor, b)
+}
+
+func (t *bitset) InPlaceAndNot(b Bitset) error {
+	return t.apply(opAndNot, b)
+}
+
+func (t *bitset) IntersectionCount(b Bitset) (uint64, error) {
+	return t.applyCount(opAnd, b)
+}
+
+func (t *bitset) UnionCount(b Bitset) (uint64, error) {
+	return t.applyCount(opOr, b)
+}
+
+func (t *bitset) XorCount(b Bitset) (uint64, error) {
+	return t.applyCount(opXor, b)
+}
+
+func (t *bitset) DifferenceCount(b Bitset) (uint64, error) {
+	return t.applyCount(opAndNot, b)
+}
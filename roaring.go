@@ -0,0 +1,597 @@
+package bitset
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// The portable Roaring serialization splits the (32-bit) indexes by their
+// high 16 bits, into containers of the set bits with the same high bits:
+//
+//	cookie   uint32  12346, or 12347 | (ncontainers-1)<<16 if there are runs
+//	[ncontainers uint32]            (only without runs)
+//	[runflags [(ncontainers+7)/8]byte] (only with runs; bit set for a run container)
+//	keys     [ncontainers](key, cardinality-1 uint16)
+//	[offsets [ncontainers]uint32]   (without runs, or with at least 4 containers)
+//	containers
+//
+// where a container is an array of sorted uint16s (with up to 4096 bits set),
+// a bitmap of 1024 uint64 words, or a uint16 number of runs followed by the
+// (start, length-1 uint16) of each run. The 64-bit variant is a uint64 number
+// of buckets, each a uint32 of the high 32 bits followed by a 32-bit bitmap.
+// All integers are little-endian.
+
+const (
+	roaringCookie      = 12347
+	roaringCookieNoRun = 12346
+	roaringNoOffsetMax = 4 // with runs, offsets are written for this many or more
+
+	roaringArrayMax    = 4096
+	roaringBitmapWords = 1024
+)
+
+type (
+	// container holds the set bits of a roaring container, as runs
+	container struct {
+		key  uint16
+		card int
+		runs []run
+	}
+
+	// bucket holds the containers of the 64-bit variant with the same high
+	// 32 bits
+	bucket struct {
+		high       uint32
+		containers []container
+	}
+)
+
+// kind returns the kind of container that's the smallest when serialized,
+// preferring an array or bitmap container to a run container of equal size
+func (c *container) kind() leafkind {
+
+	size, kind := 8*roaringBitmapWords, kindBitmap
+
+	if c.card <= roaringArrayMax {
+		size, kind = 2*c.card, kindArray
+	}
+
+	if 2+4*len(c.runs) < size {
+		kind = kindRun
+	}
+
+	return kind
+}
+
+// size returns the number of bytes of the serialized container
+func (c *container) size() int {
+
+	switch c.kind() {
+	case kindArray:
+		return 2 * c.card
+
+	case kindRun:
+		return 2 + 4*len(c.runs)
+	}
+
+	return 8 * roaringBitmapWords
+}
+
+// containers returns the containers for the set bits in [start, end], which
+// spans at most 2^32 bits (starting at a multiple of it); the bits are found
+// a run at a time, so sparse setnode subtrees become single runs
+func (t *bitset) containers(start, end uint64) (cs []container) {
+
+	for i := start; ; {
+
+		s, found := t.root.nextset(t.rootLevel, i, end)
+
+		if !found {
+			return cs
+		}
+
+		key := (s - start) >> 16
+		chunkEnd := start | key<<16 | 0xffff
+
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+
+		c := container{key: uint16(key)}
+
+		for found {
+
+			e := chunkEnd
+
+			if clr, found := t.root.nextclr(t.rootLevel, s, chunkEnd); found {
+				e = clr - 1
+			}
+
+			c.runs = append(c.runs, run{uint16(s), uint16(e)})
+			c.card += int(e-s) + 1
+
+			if e == chunkEnd {
+				break
+			}
+
+			s, found = t.root.nextset(t.rootLevel, e+1, chunkEnd)
+		}
+
+		cs = append(cs, c)
+
+		if chunkEnd == end {
+			return cs
+		}
+
+		i = chunkEnd + 1
+	}
+}
+
+func (e *encoder) writeUint16(v uint16) error {
+
+	binary.LittleEndian.PutUint16(e.buf, v)
+	return e.write(e.buf[:2])
+}
+
+func (e *encoder) writeUint32(v uint32) error {
+
+	binary.LittleEndian.PutUint32(e.buf, v)
+	return e.write(e.buf[:4])
+}
+
+func (e *encoder) writeUint64(v uint64) error {
+
+	binary.LittleEndian.PutUint64(e.buf, v)
+	return e.write(e.buf[:8])
+}
+
+// writeRoaring writes the containers as a 32-bit roaring bitmap
+func (e *encoder) writeRoaring(cs []container) error {
+
+	n := len(cs)
+
+	var runFlags []byte
+
+	for i := range cs {
+
+		if cs[i].kind() == kindRun {
+
+			if runFlags == nil {
+				runFlags = make([]byte, (n+7)/8)
+			}
+
+			runFlags[i/8] |= 1 << (uint(i) % 8)
+		}
+	}
+
+	var header int // size of the header, up to the containers
+
+	if runFlags != nil {
+
+		if err := e.writeUint32(roaringCookie | uint32(n-1)<<16); err != nil {
+			return err
+		}
+
+		if err := e.write(runFlags); err != nil {
+			return err
+		}
+
+		header = 4 + len(runFlags) + 4*n
+
+	} else {
+
+		if err := e.writeUint32(roaringCookieNoRun); err != nil {
+			return err
+		}
+
+		if err := e.writeUint32(uint32(n)); err != nil {
+			return err
+		}
+
+		header = 8 + 4*n
+	}
+
+	for i := range cs {
+
+		if err := e.writeUint16(cs[i].key); err != nil {
+			return err
+		}
+
+		if err := e.writeUint16(uint16(cs[i].card - 1)); err != nil {
+			return err
+		}
+	}
+
+	if runFlags == nil || n >= roaringNoOffsetMax {
+
+		offset := header + 4*n
+
+		for i := range cs {
+
+			if err := e.writeUint32(uint32(offset)); err != nil {
+				return err
+			}
+
+			offset += cs[i].size()
+		}
+	}
+
+	for i := range cs {
+
+		if err := e.writeContainer(&cs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *encoder) writeContainer(c *container) error {
+
+	switch c.kind() {
+	case kindArray:
+
+		for _, r := range c.runs {
+			for i := uint32(r.start); i <= uint32(r.last); i++ {
+
+				if err := e.writeUint16(uint16(i)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+
+	case kindRun:
+
+		if err := e.writeUint16(uint16(len(c.runs))); err != nil {
+			return err
+		}
+
+		for _, r := range c.runs {
+
+			if err := e.writeUint16(r.start); err != nil {
+				return err
+			}
+
+			if err := e.writeUint16(r.last - r.start); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	words := make([]uint64, roaringBitmapWords)
+
+	for _, r := range c.runs {
+		for i, end := uint64(r.start), uint64(r.last); i <= end; i = (i | 63) + 1 {
+			words[i/64] |= wordMask(i, end)
+		}
+	}
+
+	for _, w := range words {
+
+		if err := e.writeUint64(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportRoaring writes the bitset in the portable (32-bit) Roaring format;
+// returns ErrOutOfRange if any bit beyond 2^32-1 is set
+func (t *bitset) ExportRoaring(w io.Writer) (int64, error) {
+
+	end := t.max
+
+	if end > math.MaxUint32 {
+
+		if _, found := t.NextSet(math.MaxUint32 + 1); found {
+			return 0, ErrOutOfRange
+		}
+
+		end = math.MaxUint32
+	}
+
+	e := &encoder{w: w, buf: make([]byte, 8)}
+
+	err := e.writeRoaring(t.containers(0, end))
+
+	return e.n, err
+}
+
+// ExportRoaring64 writes the bitset in the portable 64-bit Roaring format
+func (t *bitset) ExportRoaring64(w io.Writer) (int64, error) {
+
+	var buckets []bucket
+
+	for i := uint64(0); ; {
+
+		s, found := t.NextSet(i)
+
+		if !found {
+			break
+		}
+
+		start, end := s&^math.MaxUint32, s|math.MaxUint32
+
+		if end > t.max {
+			end = t.max
+		}
+
+		buckets = append(buckets, bucket{
+			high:       uint32(s >> 32),
+			containers: t.containers(start, end),
+		})
+
+		if end == t.max {
+			break
+		}
+
+		i = end + 1
+	}
+
+	e := &encoder{w: w, buf: make([]byte, 8)}
+
+	if err := e.writeUint64(uint64(len(buckets))); err != nil {
+		return e.n, err
+	}
+
+	for _, b := range buckets {
+
+		if err := e.writeUint32(b.high); err != nil {
+			return e.n, err
+		}
+
+		if err := e.writeRoaring(b.containers); err != nil {
+			return e.n, err
+		}
+	}
+
+	return e.n, nil
+}
+
+func (d *decoder) readUint16() (uint16, error) {
+
+	err := d.read(d.buf[:2])
+	return binary.LittleEndian.Uint16(d.buf), err
+}
+
+func (d *decoder) readUint32() (uint32, error) {
+
+	err := d.read(d.buf[:4])
+	return binary.LittleEndian.Uint32(d.buf), err
+}
+
+func (d *decoder) readUint64() (uint64, error) {
+
+	err := d.read(d.buf[:8])
+	return binary.LittleEndian.Uint64(d.buf), err
+}
+
+// readRoaring reads a 32-bit roaring bitmap, setting its bits (offset by
+// 'high') in t
+func (d *decoder) readRoaring(t *bitset, high uint64) error {
+
+	cookie, err := d.readUint32()
+
+	if err != nil {
+		return err
+	}
+
+	var n int
+	var runFlags []byte
+
+	switch {
+	case cookie&0xffff == roaringCookie:
+
+		n = int(cookie>>16) + 1
+		runFlags = make([]byte, (n+7)/8)
+
+		if err = d.read(runFlags); err != nil {
+			return err
+		}
+
+	case cookie == roaringCookieNoRun:
+
+		count, err := d.readUint32()
+
+		if err != nil {
+			return err
+		}
+
+		if count > 1<<16 {
+			return ErrInvalidEncoding
+		}
+
+		n = int(count)
+
+	default:
+		return ErrInvalidEncoding
+	}
+
+	keys := make([]byte, 4*n)
+
+	if err = d.read(keys); err != nil {
+		return err
+	}
+
+	// the containers follow the offsets, so they're not needed
+	if runFlags == nil || n >= roaringNoOffsetMax {
+
+		if err = d.read(make([]byte, 4*n)); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < n; i++ {
+
+		key := binary.LittleEndian.Uint16(keys[4*i:])
+		card := int(binary.LittleEndian.Uint16(keys[4*i+2:])) + 1
+
+		base := high | uint64(key)<<16
+
+		if base > t.max {
+			return ErrOutOfRange
+		}
+
+		switch {
+		case runFlags != nil && runFlags[i/8]&(1<<(uint(i)%8)) != 0:
+			err = d.readRunContainer(t, base)
+
+		case card <= roaringArrayMax:
+			err = d.readArrayContainer(t, base, card)
+
+		default:
+			err = d.readBitmapContainer(t, base)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *decoder) readRunContainer(t *bitset, base uint64) error {
+
+	nruns, err := d.readUint16()
+
+	if err != nil {
+		return err
+	}
+
+	runs := make([]byte, 4*int(nruns))
+
+	if err = d.read(runs); err != nil {
+		return err
+	}
+
+	for i := 0; i < int(nruns); i++ {
+
+		start := uint64(binary.LittleEndian.Uint16(runs[4*i:]))
+		length := uint64(binary.LittleEndian.Uint16(runs[4*i+2:]))
+
+		if start+length > 0xffff {
+			return ErrInvalidEncoding
+		}
+
+		if base+start+length > t.max {
+			return ErrOutOfRange
+		}
+
+		t.SetRange(base+start, base+start+length)
+	}
+
+	return nil
+}
+
+func (d *decoder) readArrayContainer(t *bitset, base uint64, card int) error {
+
+	buf := d.buf[:2*card]
+
+	if err := d.read(buf); err != nil {
+		return err
+	}
+
+	for i := 0; i < card; i++ {
+
+		if err := t.TrySet(base + uint64(binary.LittleEndian.Uint16(buf[2*i:]))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *decoder) readBitmapContainer(t *bitset, base uint64) error {
+
+	buf := d.buf[:8*roaringBitmapWords]
+
+	if err := d.read(buf); err != nil {
+		return err
+	}
+
+	for i := 0; i < roaringBitmapWords; i++ {
+
+		w := binary.LittleEndian.Uint64(buf[8*i:])
+
+		// set the runs of bits in the word
+		for w != 0 {
+
+			start := uint64(bits.TrailingZeros64(w))
+			length := uint64(bits.TrailingZeros64(^(w >> start)))
+
+			lo := base + uint64(64*i) + start
+			hi := lo + length - 1
+
+			if hi > t.max {
+				return ErrOutOfRange
+			}
+
+			t.SetRange(lo, hi)
+
+			w &^= wordMask(start, start+length-1)
+		}
+	}
+
+	return nil
+}
+
+// ImportRoaring returns a new bitset with the given level layout, holding
+// the bits of a bitmap in the portable (32-bit) Roaring format; returns
+// ErrOutOfRange if a bit is beyond the layout's Max()
+func ImportRoaring(r io.Reader, levelBits []uint) (Bitset, error) {
+
+	b, err := NewWithError(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decoder{r: r, buf: make([]byte, 8*roaringBitmapWords)}
+
+	if err = d.readRoaring(b.(*bitset), 0); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// ImportRoaring64 is ImportRoaring, for the portable 64-bit Roaring format
+func ImportRoaring64(r io.Reader, levelBits []uint) (Bitset, error) {
+
+	b, err := NewWithError(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decoder{r: r, buf: make([]byte, 8*roaringBitmapWords)}
+
+	n, err := d.readUint64()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint64(0); i < n; i++ {
+
+		high, err := d.readUint32()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = d.readRoaring(b.(*bitset), uint64(high)<<32); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
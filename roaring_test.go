@@ -0,0 +1,141 @@
+package bitset
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the values in the fixtures, built by testdata/roaring.py
+
+func roaringValues32() (v []uint64) {
+
+	for k := uint64(0); k < 100000; k += 1000 {
+		v = append(v, k)
+	}
+
+	for k := uint64(100000); k < 200000; k++ {
+		v = append(v, 3*k)
+	}
+
+	for k := uint64(700000); k < 800000; k++ {
+		v = append(v, k)
+	}
+
+	return v
+}
+
+func roaringValues64() (v []uint64) {
+
+	v = append(v, 1, 2, 3, 1<<32|5)
+
+	for k := uint64(1<<32 + 2<<16); k < 1<<32+3<<16; k++ {
+		v = append(v, k)
+	}
+
+	return append(v, 1<<40|0xffff)
+}
+
+func readFixture(t *testing.T, name string) []byte {
+
+	data, err := os.ReadFile("testdata/" + name)
+	assert.NoError(t, err)
+
+	return data
+}
+
+func assertValues(t *testing.T, want []uint64, b Bitset) {
+
+	assert.EqualValues(t, len(want), b.Count())
+
+	for _, idx := range want {
+
+		if !b.Test(idx) {
+			assert.Fail(t, "bit not set", "%d", idx)
+			return
+		}
+	}
+}
+
+func TestRoaringImportExport(t *testing.T) {
+
+	want := readFixture(t, "roaring32-runs.bin")
+
+	for _, name := range []string{"roaring32-runs.bin", "roaring32-noruns.bin"} {
+		t.Run(name, func(t *testing.T) {
+
+			b, err := ImportRoaring(bytes.NewReader(readFixture(t, name)), []uint{12, 10, 10})
+			assert.NoError(t, err)
+			assertValues(t, roaringValues32(), b)
+
+			// exported with the smallest containers (as the runs fixture)
+			var buf bytes.Buffer
+
+			n, err := b.ExportRoaring(&buf)
+			assert.NoError(t, err)
+			assert.EqualValues(t, len(want), n)
+			assert.Equal(t, want, buf.Bytes())
+		})
+	}
+
+	t.Run("roaring32-empty.bin", func(t *testing.T) {
+
+		b, err := ImportRoaring(bytes.NewReader(readFixture(t, "roaring32-empty.bin")), []uint{16})
+		assert.NoError(t, err)
+		assert.EqualValues(t, true, b.None())
+
+		var buf bytes.Buffer
+
+		_, err = b.ExportRoaring(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, readFixture(t, "roaring32-empty.bin"), buf.Bytes())
+	})
+
+	t.Run("roaring64.bin", func(t *testing.T) {
+
+		data := readFixture(t, "roaring64.bin")
+
+		b, err := ImportRoaring64(bytes.NewReader(data), []uint{16, 16, 16, 16})
+		assert.NoError(t, err)
+		assertValues(t, roaringValues64(), b)
+
+		var buf bytes.Buffer
+
+		_, err = b.ExportRoaring64(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, data, buf.Bytes())
+
+		// only the 64-bit variant holds bits beyond 2^32-1
+		_, err = b.ExportRoaring(&buf)
+		assert.Equal(t, ErrOutOfRange, err)
+
+		c, err := NewConcurrent([]uint{16, 16, 16, 16})
+		assert.NoError(t, err)
+		assert.NoError(t, c.InPlaceOr(b))
+
+		buf.Reset()
+		_, err = c.ExportRoaring64(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, data, buf.Bytes())
+	})
+}
+
+func TestRoaringImportErrors(t *testing.T) {
+
+	data := readFixture(t, "roaring32-runs.bin")
+
+	// values beyond the layout
+	_, err := ImportRoaring(bytes.NewReader(data), []uint{8, 8})
+	assert.Equal(t, ErrOutOfRange, err)
+
+	_, err = ImportRoaring(bytes.NewReader(data[:len(data)-1]), []uint{16, 16})
+	assert.Error(t, err, "truncated")
+
+	_, err = ImportRoaring(bytes.NewReader([]byte("BSET\x01\x01\x08\x00")), []uint{16, 16})
+	assert.Equal(t, ErrInvalidEncoding, err)
+
+	_, err = ImportRoaring64(bytes.NewReader(readFixture(t, "roaring64.bin")), []uint{16, 16})
+	assert.Equal(t, ErrOutOfRange, err)
+}
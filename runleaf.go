@@ -0,0 +1,299 @@
+package bitset
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+type (
+	// runleaf is a leaf holding the runs of its set bits, for leaves whose
+	// bits are set in a few long runs (see pack)
+	runleaf struct {
+		owner  *owner // owner of the node (see level.owns)
+		numSet int    // number of bits that are set
+		runs   []run  // runs of set bits, in order (and never adjacent)
+	}
+
+	// run is a range of set bits, [start, last]
+	run struct {
+		start, last uint16
+	}
+)
+
+// newRunLeafSet returns a run leaf with all bits set, as a single run; it's
+// only used transiently, to clear bits in a desparsified setnode
+func newRunLeafSet(l *level) *runleaf {
+
+	return &runleaf{
+		owner:  l.token(),
+		numSet: l.total,
+		runs:   []run{{0, uint16(l.max)}},
+	}
+}
+
+// search returns the position of the first run ending at or after idx
+func (n *runleaf) search(idx uint64) int {
+
+	return sort.Search(len(n.runs), func(i int) bool {
+		return uint64(n.runs[i].last) >= idx
+	})
+}
+
+// find returns the position of the run holding idx, or -1 if it's clear
+func (n *runleaf) find(idx uint64) int {
+
+	if i := n.search(idx); i < len(n.runs) && uint64(n.runs[i].start) <= idx {
+		return i
+	}
+
+	return -1
+}
+
+func (n *runleaf) test(l *level, idx uint64) bool {
+	return n.find(idx) >= 0
+}
+
+func (n *runleaf) set(l *level, idx uint64) (set bool, replace node) {
+
+	i := n.search(idx)
+
+	// check if bit already set
+	if i < len(n.runs) && uint64(n.runs[i].start) <= idx {
+		return false, n
+	}
+
+	n = n.own(l) // copy-on-write, if shared
+
+	// the bit may extend the run before and/or the one after it
+	before := i > 0 && uint64(n.runs[i-1].last)+1 == idx
+	after := i < len(n.runs) && uint64(n.runs[i].start) == idx+1
+
+	switch {
+	case before && after:
+		n.runs[i-1].last = n.runs[i].last
+		n.runs = append(n.runs[:i], n.runs[i+1:]...)
+
+	case before:
+		n.runs[i-1].last++
+
+	case after:
+		n.runs[i].start--
+
+	default:
+		n.runs = append(n.runs, run{})
+		copy(n.runs[i+1:], n.runs[i:])
+		n.runs[i] = run{uint16(idx), uint16(idx)}
+	}
+
+	if n.numSet++; n.numSet == l.total {
+		return true, sparsify(l, n, true)
+	}
+
+	return true, n.repack(l)
+}
+
+func (n *runleaf) clr(l *level, idx uint64) (cleared bool, replace node) {
+
+	i := n.find(idx)
+
+	// check if bit already clear
+	if i < 0 {
+		return false, n
+	}
+
+	if n.numSet == 1 {
+		return true, sparsify(l, n, false)
+	}
+
+	n = n.own(l) // copy-on-write, if shared
+
+	switch r := n.runs[i]; {
+	case uint64(r.start) == idx && uint64(r.last) == idx:
+		n.runs = append(n.runs[:i], n.runs[i+1:]...)
+
+	case uint64(r.start) == idx:
+		n.runs[i].start++
+
+	case uint64(r.last) == idx:
+		n.runs[i].last--
+
+	default:
+		// split the run around the bit
+		n.runs = append(n.runs, run{})
+		copy(n.runs[i+1:], n.runs[i:])
+		n.runs[i].last = uint16(idx - 1)
+		n.runs[i+1].start = uint16(idx + 1)
+	}
+
+	n.numSet--
+
+	return true, n.repack(l)
+}
+
+// repack switches to another kind of leaf, if the runs are no longer the
+// smallest representation of the bits
+func (n *runleaf) repack(l *level) (replace node) {
+
+	if leafKind(l, n.numSet, len(n.runs)) != kindRun {
+		return pack(l, unpack(l, n))
+	}
+
+	return n
+}
+
+// range ops are done on a bitmap leaf, which is then packed again
+
+func (n *runleaf) setrange(l *level, start, end uint64) (changed uint64, replace node) {
+
+	changed, replace = unpack(l, n).setrange(l, start, end)
+	return changed, repack(l, replace)
+}
+
+func (n *runleaf) clrrange(l *level, start, end uint64) (changed uint64, replace node) {
+
+	changed, replace = unpack(l, n).clrrange(l, start, end)
+	return changed, repack(l, replace)
+}
+
+func (n *runleaf) fliprange(l *level, start, end uint64) (set, cleared uint64, replace node) {
+
+	set, cleared, replace = unpack(l, n).fliprange(l, start, end)
+	return set, cleared, repack(l, replace)
+}
+
+func (n *runleaf) count(l *level) (set uint64) {
+	return uint64(n.numSet)
+}
+
+func (n *runleaf) countrange(l *level, start, end uint64) (set uint64) {
+
+	for _, r := range n.runs[n.search(start):] {
+
+		if uint64(r.start) > end {
+			break
+		}
+
+		lo, hi := uint64(r.start), uint64(r.last)
+
+		if lo < start {
+			lo = start
+		}
+
+		if hi > end {
+			hi = end
+		}
+
+		set += hi - lo + 1
+	}
+
+	return set
+}
+
+func (n *runleaf) nthset(l *level, nth uint64) (idx uint64) {
+
+	for _, r := range n.runs {
+
+		c := uint64(r.last-r.start) + 1
+
+		if nth < c {
+			return uint64(r.start) + nth
+		}
+
+		nth -= c
+	}
+
+	return math.MaxUint64 // not reached
+}
+
+func (n *runleaf) nextset(l *level, start, end uint64) (idx uint64, found bool) {
+
+	if i := n.search(start); i < len(n.runs) {
+
+		if r := uint64(n.runs[i].start); r > start {
+			start = r
+		}
+
+		if start <= end {
+			return start, true
+		}
+	}
+
+	return math.MaxUint64, false
+}
+
+func (n *runleaf) prevset(l *level, start uint64) (idx uint64, found bool) {
+
+	if start > l.max {
+		start = l.max
+	}
+
+	// the last run starting at or before start
+	i := sort.Search(len(n.runs), func(i int) bool {
+		return uint64(n.runs[i].start) > start
+	}) - 1
+
+	if i < 0 {
+		return 0, false
+	}
+
+	if r := uint64(n.runs[i].last); r < start {
+		start = r
+	}
+
+	return start, true
+}
+
+func (n *runleaf) nextclr(l *level, start, end uint64) (idx uint64, found bool) {
+
+	// runs are never adjacent, so the bit after a run is clear
+	if i := n.find(start); i >= 0 {
+		start = uint64(n.runs[i].last) + 1
+	}
+
+	if start <= end {
+		return start, true
+	}
+
+	return math.MaxUint64, false
+}
+
+func (n *runleaf) prevclr(l *level, start uint64) (idx uint64, found bool) {
+
+	if start > l.max {
+		start = l.max
+	}
+
+	// runs are never adjacent, so the bit before a run is clear
+	if i := n.find(start); i >= 0 {
+
+		if n.runs[i].start == 0 {
+			return 0, false
+		}
+
+		start = uint64(n.runs[i].start) - 1
+	}
+
+	return start, true
+}
+
+// own returns the leaf itself if it's owned by the tree of level l (see
+// level.owns); otherwise the leaf is shared with a clone, and a copy of it is
+// returned to be modified
+func (n *runleaf) own(l *level) *runleaf {
+
+	if l.owns(n.owner) {
+		return n
+	}
+
+	return &runleaf{
+		owner:  l.token(),
+		numSet: n.numSet,
+		runs:   append([]run(nil), n.runs...),
+	}
+}
+
+func (n *runleaf) String() string {
+	return fmt.Sprintf("runleaf(%p): owner=%p numSet=%d runs=%v",
+		n, n.owner, n.numSet, n.runs)
+}
@@ -0,0 +1,66 @@
+package bitset
+
+import (
+	"iter"
+)
+
+// SetBits returns an iterator over the set bits, in increasing order
+func (t *bitset) SetBits() iter.Seq[uint64] {
+
+	return func(yield func(idx uint64) bool) {
+
+		for i := uint64(0); ; i++ {
+
+			var found bool
+
+			if i, found = t.root.nextset(t.rootLevel, i, t.max); !found || !yield(i) || i == t.max {
+				return
+			}
+		}
+	}
+}
+
+// Backward returns an iterator over the set bits, in decreasing order
+func (t *bitset) Backward() iter.Seq[uint64] {
+
+	return func(yield func(idx uint64) bool) {
+
+		for i := t.max; ; i-- {
+
+			var found bool
+
+			if i, found = t.root.prevset(t.rootLevel, i); !found || !yield(i) || i == 0 {
+				return
+			}
+		}
+	}
+}
+
+// Ranges returns an iterator over the runs of set bits, as the (inclusive)
+// start and end index of each run, in increasing order
+func (t *bitset) Ranges() iter.Seq2[uint64, uint64] {
+
+	return func(yield func(start, end uint64) bool) {
+
+		for i := uint64(0); ; {
+
+			start, found := t.root.nextset(t.rootLevel, i, t.max)
+
+			if !found {
+				return
+			}
+
+			end := t.max
+
+			if clr, found := t.root.nextclr(t.rootLevel, start, t.max); found {
+				end = clr - 1
+			}
+
+			if !yield(start, end) || end == t.max {
+				return
+			}
+
+			i = end + 1 // clear, so the next run starts after it
+		}
+	}
+}
@@ -2,14 +2,18 @@ package bitset
 
 import (
 	"math"
-	"unsafe"
 )
 
 // setnode defines a sparse node with all bits set
 type setnode struct{}
 
+// theSetnode is the (stateless) setnode shared by all sparse all-set nodes
+// (rather than a sentinel made from an invalid unsafe.Pointer, which go vet
+// flags as a misuse)
+var theSetnode = &setnode{}
+
 func newSparseSet(l *level) *setnode {
-	return (*setnode)(unsafe.Pointer(uintptr(math.MaxUint64)))
+	return theSetnode
 }
 
 func newSparseClr(l *level) *clrnode {
@@ -30,20 +34,61 @@ func (sn *setnode) clr(l *level, idx uint64) (cleared bool, replace node) {
 	return desparsify(l, sn, true).clr(l, idx)
 }
 
-func (sn *setnode) nextset(l *level, start uint64) (idx uint64, found bool) {
+func (sn *setnode) setrange(l *level, start, end uint64) (changed uint64, replace node) {
+	// set on a set-node -> no-op
+	return 0, sn
+}
+
+func (sn *setnode) clrrange(l *level, start, end uint64) (changed uint64, replace node) {
+
+	// range covers the whole node -> replace with an all-clr node (the count
+	// wraps to 0 with 64 bits, see bitset.full)
+	if start == 0 && end == l.max {
+		return end + 1, newNode(l, true, false)
+	}
+
+	// desparsify and do 'clrrange' on the new node
+	return desparsify(l, sn, true).clrrange(l, start, end)
+}
+
+func (sn *setnode) fliprange(l *level, start, end uint64) (set, cleared uint64, replace node) {
+
+	// range covers the whole node -> swap with an all-clr node (the count
+	// wraps to 0 with 64 bits, see bitset.full)
+	if start == 0 && end == l.max {
+		return 0, end + 1, newNode(l, true, false)
+	}
+
+	// desparsify and do 'fliprange' on the new node
+	return desparsify(l, sn, true).fliprange(l, start, end)
+}
+
+func (sn *setnode) count(l *level) (set uint64) {
+	return l.max + 1
+}
+
+func (sn *setnode) countrange(l *level, start, end uint64) (set uint64) {
+	return end - start + 1
+}
+
+func (sn *setnode) nthset(l *level, n uint64) (idx uint64) {
+	return n
+}
+
+func (sn *setnode) nextset(l *level, start, end uint64) (idx uint64, found bool) {
 	return start, true
 }
 
 func (sn *setnode) prevset(l *level, start uint64) (idx uint64, found bool) {
 
-	if start >= uint64(l.total) {
-		return uint64(l.total - 1), true
+	if start > l.max {
+		return l.max, true
 	}
 
 	return start, true
 }
 
-func (sn *setnode) nextclr(l *level, start uint64) (idx uint64, found bool) {
+func (sn *setnode) nextclr(l *level, start, end uint64) (idx uint64, found bool) {
 	return math.MaxUint64, false
 }
 
@@ -68,7 +113,48 @@ func (cn *clrnode) clr(l *level, idx uint64) (cleared bool, replace node) {
 	return false, cn
 }
 
-func (cn *clrnode) nextset(l *level, start uint64) (idx uint64, found bool) {
+func (cn *clrnode) setrange(l *level, start, end uint64) (changed uint64, replace node) {
+
+	// range covers the whole node -> replace with an all-set node (the count
+	// wraps to 0 with 64 bits, see bitset.full)
+	if start == 0 && end == l.max {
+		return end + 1, newNode(l, true, true)
+	}
+
+	// desparsify and do 'setrange' on the new node
+	return desparsify(l, cn, false).setrange(l, start, end)
+}
+
+func (cn *clrnode) clrrange(l *level, start, end uint64) (changed uint64, replace node) {
+	// clear on a clr-node -> no-op
+	return 0, cn
+}
+
+func (cn *clrnode) fliprange(l *level, start, end uint64) (set, cleared uint64, replace node) {
+
+	// range covers the whole node -> swap with an all-set node (the count
+	// wraps to 0 with 64 bits, see bitset.full)
+	if start == 0 && end == l.max {
+		return end + 1, 0, newNode(l, true, true)
+	}
+
+	// desparsify and do 'fliprange' on the new node
+	return desparsify(l, cn, false).fliprange(l, start, end)
+}
+
+func (cn *clrnode) count(l *level) (set uint64) {
+	return 0
+}
+
+func (cn *clrnode) countrange(l *level, start, end uint64) (set uint64) {
+	return 0
+}
+
+func (cn *clrnode) nthset(l *level, n uint64) (idx uint64) {
+	return math.MaxUint64 // no set bits
+}
+
+func (cn *clrnode) nextset(l *level, start, end uint64) (idx uint64, found bool) {
 	return math.MaxUint64, false
 }
 
@@ -76,14 +162,14 @@ func (cn *clrnode) prevset(l *level, start uint64) (idx uint64, found bool) {
 	return 0, false
 }
 
-func (cn *clrnode) nextclr(l *level, start uint64) (idx uint64, found bool) {
+func (cn *clrnode) nextclr(l *level, start, end uint64) (idx uint64, found bool) {
 	return start, true
 }
 
 func (cn *clrnode) prevclr(l *level, start uint64) (idx uint64, found bool) {
 
-	if start >= uint64(l.total) {
-		return uint64(l.total - 1), true
+	if start > l.max {
+		return l.max, true
 	}
 
 	return start, true
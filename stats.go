@@ -0,0 +1,150 @@
+package bitset
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type (
+	// Stats describes the structure of a bitset's tree, and its (estimated)
+	// memory use, to help pick a level layout and to watch for blowups
+	Stats struct {
+		Levels []LevelStats // root level first
+
+		Bytes       float64 // estimated bytes used by the nodes
+		FlatBytes   float64 // bytes used by a flat bitmap of Cap() bits
+		Compression float64 // FlatBytes/Bytes (+Inf, with no nodes materialized)
+	}
+
+	// LevelStats describes the nodes at a level of the tree
+	LevelStats struct {
+		Bits uint // bits of the index allocated to the level
+
+		Inodes int // materialized inodes
+		Leaves int // materialized leaves, of any kind
+
+		ArrayLeaves int // leaves holding offsets (see arrayleaf)
+		RunLeaves   int // leaves holding runs (see runleaf)
+
+		SetNodes int // sparse all-set nodes
+		ClrNodes int // sparse all-clr nodes
+
+		Bytes float64 // estimated bytes used by the nodes
+
+		// Fill is the histogram of the leaves' fill ratio (numSet/total):
+		// Fill[i] counts the leaves with a ratio in [i/10, (i+1)/10)
+		Fill [10]int
+	}
+)
+
+// NumNodes returns the number of materialized nodes at each level (root first)
+func (s Stats) NumNodes() []int {
+
+	numNodes := make([]int, len(s.Levels))
+
+	for i, ls := range s.Levels {
+		numNodes[i] = ls.Inodes + ls.Leaves
+	}
+
+	return numNodes
+}
+
+func (s Stats) String() string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "nodes=%v bytes=%.0f flat=%.0f compression=%.2fx",
+		s.NumNodes(), s.Bytes, s.FlatBytes, s.Compression)
+
+	for _, ls := range s.Levels {
+
+		fmt.Fprintf(&b, "\n  bits=%d inodes=%d leaves=%d (array=%d run=%d) set=%d clr=%d bytes=%.0f",
+			ls.Bits, ls.Inodes, ls.Leaves, ls.ArrayLeaves, ls.RunLeaves, ls.SetNodes, ls.ClrNodes, ls.Bytes)
+
+		if ls.Leaves > 0 {
+			fmt.Fprintf(&b, " fill=%v", ls.Fill)
+		}
+	}
+
+	return b.String()
+}
+
+// Stats walks the tree, and returns its structure and estimated memory use
+func (t *bitset) Stats() (s Stats) {
+
+	s.Levels = make([]LevelStats, t.rootLevel.height+1)
+
+	for l := t.rootLevel; l != nil; l = l.next {
+		s.Levels[t.rootLevel.height-l.height].Bits = l.bits
+	}
+
+	nodeStats(t.rootLevel, t.root, s.Levels)
+
+	s.total(t.rootLevel)
+
+	return s
+}
+
+// nodeStats accounts for the node (and the nodes under it) in the stats of the
+// levels, given starting with those of its own level
+func nodeStats(l *level, n node, levels []LevelStats) {
+
+	ls := &levels[0]
+
+	switch n := n.(type) {
+	case *setnode:
+		ls.SetNodes++
+
+	case *clrnode:
+		ls.ClrNodes++
+
+	case *inode:
+
+		ls.Inodes++
+		ls.Bytes += inodeBytes + childBytes*float64(cap(n.nodes))
+
+		for _, nx := range n.nodes {
+			nodeStats(l.next, nx, levels[1:])
+		}
+
+	case *leaf:
+
+		ls.Leaves++
+		ls.Bytes += leafBytes + 8*float64(cap(n.bits))
+		ls.fill(l, n.numSet)
+
+	case *arrayleaf:
+
+		ls.Leaves++
+		ls.ArrayLeaves++
+		ls.Bytes += arrayLeafBytes + 2*float64(cap(n.offsets))
+		ls.fill(l, len(n.offsets))
+
+	case *runleaf:
+
+		ls.Leaves++
+		ls.RunLeaves++
+		ls.Bytes += runLeafBytes + 4*float64(cap(n.runs))
+		ls.fill(l, n.numSet)
+	}
+}
+
+// fill adds a leaf of the level, with numSet bits set, to the histogram
+func (ls *LevelStats) fill(l *level, numSet int) {
+	ls.Fill[min(numSet*len(ls.Fill)/l.total, len(ls.Fill)-1)]++
+}
+
+// total sums up the bytes used by the levels, and compares them with those
+// of a flat bitmap with the capacity of the given (root) level
+func (s *Stats) total(l *level) {
+
+	s.Bytes = 0
+
+	for _, ls := range s.Levels {
+		s.Bytes += ls.Bytes
+	}
+
+	s.FlatBytes = math.Ldexp(1, int(l.shift+l.bits)-3)
+	s.Compression = s.FlatBytes / s.Bytes
+}
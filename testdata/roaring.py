@@ -0,0 +1,103 @@
+#!/usr/bin/env python3
+#
+# Builds the roaring fixtures in this directory, straight from the portable
+# Roaring format spec (https://github.com/RoaringBitmap/RoaringFormatSpec),
+# independently of the Go code under test. The values are the same as in
+# roaring_test.go.
+
+import struct
+
+def values32():
+    v = set(range(0, 100000, 1000))
+    v |= set(3 * k for k in range(100000, 200000))
+    v |= set(range(700000, 800000))
+    return v
+
+def values64():
+    v = {1, 2, 3, 1 << 32 | 5}
+    v |= set(range((1 << 32) + (2 << 16), (1 << 32) + (3 << 16)))
+    v |= {1 << 40 | 0xffff}
+    return v
+
+def runs_of(vals):
+    runs = []
+    for x in sorted(vals):
+        if runs and runs[-1][1] + 1 == x:
+            runs[-1][1] = x
+        else:
+            runs.append([x, x])
+    return runs
+
+def serialize32(vals, with_runs):
+    keys = {}
+    for x in vals:
+        keys.setdefault(x >> 16, set()).add(x & 0xffff)
+
+    containers = []
+    for key in sorted(keys):
+        lows = keys[key]
+        card = len(lows)
+        runs = runs_of(lows)
+        kind, size = ('bitmap', 8192) if card > 4096 else ('array', 2 * card)
+        if with_runs and 2 + 4 * len(runs) < size:
+            kind = 'run'
+        if kind == 'array':
+            data = b''.join(struct.pack('<H', x) for x in sorted(lows))
+        elif kind == 'bitmap':
+            words = [0] * 1024
+            for x in lows:
+                words[x // 64] |= 1 << (x % 64)
+            data = b''.join(struct.pack('<Q', w) for w in words)
+        else:
+            data = struct.pack('<H', len(runs))
+            data += b''.join(struct.pack('<HH', s, e - s) for s, e in runs)
+        containers.append((key, card, kind, data))
+
+    n = len(containers)
+    has_runs = any(c[2] == 'run' for c in containers)
+
+    out = b''
+    if has_runs:
+        out += struct.pack('<I', 12347 | (n - 1) << 16)
+        flags = bytearray((n + 7) // 8)
+        for i, c in enumerate(containers):
+            if c[2] == 'run':
+                flags[i // 8] |= 1 << (i % 8)
+        out += bytes(flags)
+    else:
+        out += struct.pack('<II', 12346, n)
+
+    for key, card, _, _ in containers:
+        out += struct.pack('<HH', key, card - 1)
+
+    if not has_runs or n >= 4:
+        offset = len(out) + 4 * n
+        for c in containers:
+            out += struct.pack('<I', offset)
+            offset += len(c[3])
+
+    for c in containers:
+        out += c[3]
+
+    return out
+
+def serialize64(vals):
+    highs = {}
+    for x in vals:
+        highs.setdefault(x >> 32, set()).add(x & 0xffffffff)
+
+    out = struct.pack('<Q', len(highs))
+    for high in sorted(highs):
+        out += struct.pack('<I', high) + serialize32(highs[high], True)
+
+    return out
+
+if __name__ == '__main__':
+    with open('roaring32-runs.bin', 'wb') as f:
+        f.write(serialize32(values32(), True))
+    with open('roaring32-noruns.bin', 'wb') as f:
+        f.write(serialize32(values32(), False))
+    with open('roaring32-empty.bin', 'wb') as f:
+        f.write(serialize32(set(), False))
+    with open('roaring64.bin', 'wb') as f:
+        f.write(serialize64(values64()))
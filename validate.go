@@ -0,0 +1,206 @@
+package bitset
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+)
+
+// ErrInvalid is returned by Validate, wrapped with the details of the first
+// inconsistency found in the tree
+var ErrInvalid = errors.New("bitset: invalid tree")
+
+// invalid returns an ErrInvalid for the node at the given base index
+func invalid(l *level, base uint64, f string, a ...interface{}) error {
+	return fmt.Errorf("%w: node at %d (height %d): %s", ErrInvalid, base, l.height, fmt.Sprintf(f, a...))
+}
+
+// Validate walks the tree, and checks that the counters (of the bitset and
+// of its nodes) agree with the bits that are set, that the nodes are in
+// their canonical form (no all-set/all-clr inode or leaf that should have
+// been sparsified), and that the per-level node counts match Stats()
+func (t *bitset) Validate() error {
+
+	set, err := validate(t.rootLevel, t.root, 0)
+
+	if err != nil {
+		return err
+	}
+
+	if set != t.count {
+		return fmt.Errorf("%w: count %d, but %d bits set", ErrInvalid, t.count, set)
+	}
+
+	numNodes := t.Stats().NumNodes()
+
+	for l, i := t.rootLevel, 0; l != nil; l, i = l.next, i+1 {
+
+		if l.numNodes != numNodes[i] {
+			return fmt.Errorf("%w: %d nodes at height %d, but %d in the tree",
+				ErrInvalid, l.numNodes, l.height, numNodes[i])
+		}
+	}
+
+	return nil
+}
+
+// validate checks the node (at the given level and base index) and the
+// nodes under it, returning the number of bits set under it (mod 2^64)
+func validate(l *level, n node, base uint64) (set uint64, err error) {
+
+	switch n := n.(type) {
+	case *setnode:
+		return l.max + 1, nil // NB: wraps to 0 with 64 bits
+
+	case *clrnode:
+		return 0, nil
+
+	case *inode:
+
+		if l.leaf {
+			return 0, invalid(l, base, "inode at the leaf level")
+		}
+
+		if len(n.nodes) != l.total {
+			return 0, invalid(l, base, "inode with %d children, for %d", len(n.nodes), l.total)
+		}
+
+		var nSet, nClr int
+
+		for i, nx := range n.nodes {
+
+			switch nx.(type) {
+			case *setnode:
+				nSet++
+
+			case *clrnode:
+				nClr++
+
+			case nil:
+				return 0, invalid(l, base, "nil child %d", i)
+			}
+
+			c, err := validate(l.next, nx, base+uint64(i)<<l.shift)
+
+			if err != nil {
+				return 0, err
+			}
+
+			set += c
+		}
+
+		if nSet != n.nSet || nClr != n.nClr {
+			return 0, invalid(l, base, "inode nSet/nClr %d/%d, but %d/%d children",
+				n.nSet, n.nClr, nSet, nClr)
+		}
+
+		if nSet == l.total || nClr == l.total {
+			return 0, invalid(l, base, "inode with all children sparse, not sparsified")
+		}
+
+		if set != n.numSet {
+			return 0, invalid(l, base, "inode numSet %d, but %d bits set", n.numSet, set)
+		}
+
+		return set, nil
+
+	case *leaf:
+
+		if !l.leaf {
+			return 0, invalid(l, base, "leaf above the leaf level")
+		}
+
+		if len(n.bits) != leafWords(l) {
+			return 0, invalid(l, base, "leaf with %d words, for %d", len(n.bits), leafWords(l))
+		}
+
+		// the bits beyond the size of the leaf must be clear
+		if r := l.total % 64; r != 0 && n.bits[len(n.bits)-1]>>uint(r) != 0 {
+			return 0, invalid(l, base, "leaf with bits set beyond %d", l.total)
+		}
+
+		for _, w := range n.bits {
+			set += uint64(bits.OnesCount64(w))
+		}
+
+		if set != uint64(n.numSet) {
+			return 0, invalid(l, base, "leaf numSet %d, but %d bits set", n.numSet, set)
+		}
+
+	case *arrayleaf:
+
+		if !l.adaptive {
+			return 0, invalid(l, base, "array leaf at a level that isn't adaptive")
+		}
+
+		if len(n.offsets) > arrayMax(l) {
+			return 0, invalid(l, base, "array leaf with %d offsets, for at most %d", len(n.offsets), arrayMax(l))
+		}
+
+		for i, o := range n.offsets {
+
+			if int(o) >= l.total || i > 0 && o <= n.offsets[i-1] {
+				return 0, invalid(l, base, "array leaf with offset %d out of order", o)
+			}
+		}
+
+		set = uint64(len(n.offsets))
+
+	case *runleaf:
+
+		if !l.adaptive {
+			return 0, invalid(l, base, "run leaf at a level that isn't adaptive")
+		}
+
+		for i, r := range n.runs {
+
+			if r.start > r.last || int(r.last) >= l.total || i > 0 && uint64(r.start) <= uint64(n.runs[i-1].last)+1 {
+				return 0, invalid(l, base, "run leaf with run %v out of order (or adjacent)", r)
+			}
+
+			set += uint64(r.last-r.start) + 1
+		}
+
+		if set != uint64(n.numSet) {
+			return 0, invalid(l, base, "run leaf numSet %d, but %d bits set", n.numSet, set)
+		}
+
+	default:
+		return 0, invalid(l, base, "unknown node %T", n)
+	}
+
+	// materialized leaves of any kind
+	if set == 0 || set == uint64(l.total) {
+		return 0, invalid(l, base, "leaf with all bits set/clr, not sparsified")
+	}
+
+	return set, nil
+}
+
+// Validate checks each of the stripes (see bitset.Validate), and that their
+// counts add up to the count of the bitset
+func (t *concurrent) Validate() error {
+
+	t.rlockAll()
+	defer t.runlockAll()
+
+	var count uint64
+
+	for i := range t.stripes {
+
+		b := t.stripes[i].b
+
+		if err := b.Validate(); err != nil {
+			return fmt.Errorf("stripe %d: %w", i, err)
+		}
+
+		count += b.count
+	}
+
+	if c := atomic.LoadUint64(&t.count); c != count {
+		return fmt.Errorf("%w: count %d, but %d in the stripes", ErrInvalid, c, count)
+	}
+
+	return nil
+}
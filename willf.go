@@ -0,0 +1,507 @@
+package bitset
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	wb "github.com/willf/bitset"
+)
+
+type (
+	// BitSet exposes a sparse bitset through the method set (and semantics)
+	// of github.com/willf/bitset's BitSet, so that code written against it
+	// can switch over by changing the import and the constructor.
+	//
+	// As there, a BitSet has a length: setting (or flipping) a bit at or
+	// beyond it extends the length to hold the bit, bits at or beyond it
+	// test clear, and Complement flips the bits below it. Unlike there, the
+	// capacity is fixed by the level layout, and setting a bit beyond Max()
+	// panics with ErrOutOfRange.
+	BitSet struct {
+		t      *bitset
+		length uint
+	}
+)
+
+// NewBitSet returns a BitSet of the given length, with the given level
+// layout (leaf level first); the length may be at most Max()+1
+func NewBitSet(length uint, levelBits []uint) (*BitSet, error) {
+
+	b, err := NewWithError(levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := b.(*bitset)
+
+	if length > 0 && uint64(length-1) > t.max {
+		return nil, ErrOutOfRange
+	}
+
+	return &BitSet{t: t, length: length}, nil
+}
+
+// FromWillf returns a BitSet with the length and bits of the given willf
+// BitSet, with the given level layout
+func FromWillf(w *wb.BitSet, levelBits []uint) (*BitSet, error) {
+
+	b, err := NewBitSet(w.Len(), levelBits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// set the bits a run at a time
+	for start, ok := w.NextSet(0); ok; {
+
+		end, clr := w.NextClear(start)
+
+		if !clr {
+			end = w.Len()
+		}
+
+		b.t.SetRange(uint64(start), uint64(end-1))
+
+		start, ok = w.NextSet(end)
+	}
+
+	return b, nil
+}
+
+// ToWillf returns a willf BitSet with the length and bits of the BitSet
+func (b *BitSet) ToWillf() *wb.BitSet {
+
+	w := wb.New(b.length)
+
+	b.t.ForEachSet(func(idx uint64) bool {
+		w.Set(uint(idx))
+		return true
+	})
+
+	return w
+}
+
+// Bitset returns the underlying sparse bitset, which shares the bits with b
+// (bits may be set or cleared through it, but only below Len())
+func (b *BitSet) Bitset() Bitset {
+	return b.t
+}
+
+// other returns the bits of 'c' in a bitset with the layout of b's, so the
+// two can be merged (converting them, if the layouts differ)
+func (b *BitSet) other(c *BitSet) *bitset {
+
+	if sameLayout(b.t.rootLevel, c.t.rootLevel) {
+		return c.t
+	}
+
+	o := New(b.t.levelBits()).(*bitset)
+
+	for start, end := range c.t.Ranges() {
+
+		if end > o.max {
+			panic(ErrOutOfRange)
+		}
+
+		o.SetRange(start, end)
+	}
+
+	return o
+}
+
+// extend grows the length to hold bit i, if it's beyond it
+func (b *BitSet) extend(i uint) {
+
+	if i >= b.length {
+
+		if uint64(i) > b.t.max {
+			panic(ErrOutOfRange)
+		}
+
+		b.length = i + 1
+	}
+}
+
+// wrap returns a BitSet of the given length over t
+func wrap(t *bitset, length uint) *BitSet {
+	return &BitSet{t: t, length: length}
+}
+
+func (b *BitSet) Len() uint {
+	return b.length
+}
+
+func (b *BitSet) Test(i uint) bool {
+
+	if i >= b.length {
+		return false
+	}
+
+	return b.t.Test(uint64(i))
+}
+
+func (b *BitSet) Set(i uint) *BitSet {
+
+	b.extend(i)
+	b.t.Set(uint64(i))
+
+	return b
+}
+
+func (b *BitSet) Clear(i uint) *BitSet {
+
+	if i < b.length {
+		b.t.Clear(uint64(i))
+	}
+
+	return b
+}
+
+func (b *BitSet) SetTo(i uint, value bool) *BitSet {
+
+	if value {
+		return b.Set(i)
+	}
+
+	return b.Clear(i)
+}
+
+func (b *BitSet) Flip(i uint) *BitSet {
+
+	if i >= b.length {
+		return b.Set(i)
+	}
+
+	b.t.Flip(uint64(i))
+
+	return b
+}
+
+func (b *BitSet) NextSet(i uint) (uint, bool) {
+
+	if i >= b.length {
+		return 0, false
+	}
+
+	if idx, found := b.t.NextSet(uint64(i)); found {
+		return uint(idx), true
+	}
+
+	return 0, false
+}
+
+func (b *BitSet) NextClear(i uint) (uint, bool) {
+
+	if i >= b.length {
+		return 0, false
+	}
+
+	if idx, found := b.t.NextClear(uint64(i)); found && idx < uint64(b.length) {
+		return uint(idx), true
+	}
+
+	return 0, false
+}
+
+// ClearAll clears all the bits, keeping the length
+func (b *BitSet) ClearAll() *BitSet {
+
+	b.t.ClearAll()
+
+	return b
+}
+
+func (b *BitSet) Clone() *BitSet {
+	return wrap(b.t.Clone().(*bitset), b.length)
+}
+
+// Copy copies the bits of b into c, replacing c's bits in the words that b
+// has (as in willf), and returns the number of bits copied; unlike willf,
+// bits at or beyond c's length are never set
+func (b *BitSet) Copy(c *BitSet) (count uint) {
+
+	if end := min(wordsNeeded(b.length)*64, c.length); end > 0 {
+
+		c.t.ClearRange(0, uint64(end-1))
+
+		b.t.ForEachSetRange(0, uint64(end-1), func(idx uint64) bool {
+			c.t.Set(idx)
+			return true
+		})
+	}
+
+	return min(b.length, c.length)
+}
+
+func (b *BitSet) Count() uint {
+	return uint(b.t.Count())
+}
+
+// All returns whether all the bits below the length are set
+func (b *BitSet) All() bool {
+	return b.Count() == b.length
+}
+
+func (b *BitSet) Any() bool {
+	return b.t.Any()
+}
+
+func (b *BitSet) None() bool {
+	return b.t.None()
+}
+
+// Equal returns whether b and c have the same length, and the same bits set
+func (b *BitSet) Equal(c *BitSet) bool {
+
+	if c == nil || b.length != c.length || b.t.Count() != c.t.Count() {
+		return false
+	}
+
+	n, _ := b.t.XorCount(b.other(c))
+
+	return n == 0
+}
+
+// Complement returns a BitSet of the same length, with the bits below the
+// length flipped
+func (b *BitSet) Complement() (result *BitSet) {
+
+	result = b.Clone()
+
+	if b.length > 0 {
+		result.t.FlipRange(0, uint64(b.length-1))
+	}
+
+	return result
+}
+
+// binary ops; as in willf, the result has the length of the longer of the
+// two operands, except for Intersection (the shorter) and Difference (b's)
+
+func (b *BitSet) Union(compare *BitSet) (result *BitSet) {
+
+	r, _ := b.t.Or(b.other(compare))
+
+	return wrap(r.(*bitset), max(b.length, compare.length))
+}
+
+func (b *BitSet) Intersection(compare *BitSet) (result *BitSet) {
+
+	r, _ := b.t.And(b.other(compare))
+
+	return wrap(r.(*bitset), min(b.length, compare.length))
+}
+
+func (b *BitSet) Difference(compare *BitSet) (result *BitSet) {
+
+	r, _ := b.t.AndNot(b.other(compare))
+
+	return wrap(r.(*bitset), b.length)
+}
+
+func (b *BitSet) SymmetricDifference(compare *BitSet) (result *BitSet) {
+
+	r, _ := b.t.Xor(b.other(compare))
+
+	return wrap(r.(*bitset), max(b.length, compare.length))
+}
+
+func (b *BitSet) InPlaceUnion(compare *BitSet) {
+
+	b.t.InPlaceOr(b.other(compare))
+	b.length = max(b.length, compare.length)
+}
+
+// InPlaceIntersection keeps the bits also set in compare; as in willf, the
+// length is extended to compare's, if it's longer
+func (b *BitSet) InPlaceIntersection(compare *BitSet) {
+
+	b.t.InPlaceAnd(b.other(compare))
+	b.length = max(b.length, compare.length)
+}
+
+func (b *BitSet) InPlaceDifference(compare *BitSet) {
+	b.t.InPlaceAndNot(b.other(compare))
+}
+
+func (b *BitSet) InPlaceSymmetricDifference(compare *BitSet) {
+
+	b.t.InPlaceXor(b.other(compare))
+	b.length = max(b.length, compare.length)
+}
+
+func (b *BitSet) UnionCardinality(compare *BitSet) uint {
+
+	n, _ := b.t.UnionCount(b.other(compare))
+	return uint(n)
+}
+
+func (b *BitSet) IntersectionCardinality(compare *BitSet) uint {
+
+	n, _ := b.t.IntersectionCount(b.other(compare))
+	return uint(n)
+}
+
+func (b *BitSet) DifferenceCardinality(compare *BitSet) uint {
+
+	n, _ := b.t.DifferenceCount(b.other(compare))
+	return uint(n)
+}
+
+func (b *BitSet) SymmetricDifferenceCardinality(compare *BitSet) uint {
+
+	n, _ := b.t.XorCount(b.other(compare))
+	return uint(n)
+}
+
+// IsSuperSet returns whether all the bits set in other are set in b
+func (b *BitSet) IsSuperSet(other *BitSet) bool {
+
+	n, _ := other.t.DifferenceCount(other.other(b))
+
+	return n == 0
+}
+
+// IsStrictSuperSet returns whether b is a superset of other, with more bits set
+func (b *BitSet) IsStrictSuperSet(other *BitSet) bool {
+	return b.Count() > other.Count() && b.IsSuperSet(other)
+}
+
+// wordsNeeded returns the number of words that hold the given number of bits
+func wordsNeeded(length uint) uint {
+	return (length + 63) / 64
+}
+
+// word returns the i-th 64-bit word of the bits
+func (b *BitSet) word(i uint) (w uint64) {
+
+	start := uint64(i) * 64
+
+	b.t.ForEachSetRange(start, start+63, func(idx uint64) bool {
+		w |= 1 << (idx % 64)
+		return true
+	})
+
+	return w
+}
+
+// Bytes returns the bits as words, as many as the length needs
+func (b *BitSet) Bytes() []uint64 {
+
+	words := make([]uint64, wordsNeeded(b.length))
+
+	b.t.ForEachSet(func(idx uint64) bool {
+		words[idx/64] |= 1 << (idx % 64)
+		return true
+	})
+
+	return words
+}
+
+// BinaryStorageSize returns the size of the willf binary encoding
+func (b *BitSet) BinaryStorageSize() int {
+	return int(8 + 8*wordsNeeded(b.length))
+}
+
+// DumpAsBits returns the words in binary, the highest first
+func (b *BitSet) DumpAsBits() string {
+
+	var buf strings.Builder
+
+	for i := int(wordsNeeded(b.length)) - 1; i >= 0; i-- {
+		fmt.Fprintf(&buf, "%064b.", b.word(uint(i)))
+	}
+
+	return buf.String()
+}
+
+// String returns the set bits as "{1,2,3}", with at most 0x40000 of them
+func (b *BitSet) String() string {
+
+	const maxEntries = 0x40000 // as in willf
+
+	var buf strings.Builder
+	buf.WriteString("{")
+
+	n := 0
+
+	b.t.ForEachSet(func(idx uint64) bool {
+
+		if n++; n > maxEntries {
+			buf.WriteString("...")
+			return false
+		}
+
+		if n > 1 {
+			buf.WriteString(",")
+		}
+
+		fmt.Fprintf(&buf, "%d", idx)
+
+		return true
+	})
+
+	buf.WriteString("}")
+
+	return buf.String()
+}
+
+// the encodings are willf's, so they interoperate with it
+
+func (b *BitSet) WriteTo(stream io.Writer) (int64, error) {
+	return b.ToWillf().WriteTo(stream)
+}
+
+// ReadFrom reads a willf-encoded BitSet, keeping b's level layout
+func (b *BitSet) ReadFrom(stream io.Reader) (int64, error) {
+
+	w := new(wb.BitSet)
+	n, err := w.ReadFrom(stream)
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, b.from(w)
+}
+
+func (b *BitSet) MarshalBinary() ([]byte, error) {
+	return b.ToWillf().MarshalBinary()
+}
+
+func (b *BitSet) UnmarshalBinary(data []byte) error {
+	_, err := b.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+func (b *BitSet) MarshalJSON() ([]byte, error) {
+	return b.ToWillf().MarshalJSON()
+}
+
+func (b *BitSet) UnmarshalJSON(data []byte) error {
+
+	w := new(wb.BitSet)
+
+	if err := w.UnmarshalJSON(data); err != nil {
+		return err
+	}
+
+	return b.from(w)
+}
+
+// from replaces the length and bits of b with those of w
+func (b *BitSet) from(w *wb.BitSet) error {
+
+	c, err := FromWillf(w, b.t.levelBits())
+
+	if err != nil {
+		return err
+	}
+
+	*b = *c
+
+	return nil
+}
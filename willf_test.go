@@ -0,0 +1,185 @@
+package bitset
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	wb "github.com/willf/bitset"
+)
+
+// assertSameBitSet checks the BitSet against the willf BitSet it should match
+func assertSameBitSet(t *testing.T, want *wb.BitSet, b *BitSet) {
+
+	assert.Equal(t, want.Len(), b.Len())
+	assert.Equal(t, want.Count(), b.Count())
+	assert.Equal(t, want.DumpAsBits(), b.DumpAsBits())
+	assert.Equal(t, want.String(), b.String())
+	assert.True(t, want.Equal(b.ToWillf()))
+}
+
+func TestBitSetWillf(t *testing.T) {
+
+	for _, cfg := range configs {
+		t.Run(fmt.Sprintf("%v", cfg), func(t *testing.T) {
+
+			r := rand.New(rand.NewSource(1))
+
+			max := uint(New(cfg).Max())
+
+			b, err := NewBitSet(min(100, max), cfg)
+			assert.NoError(t, err)
+
+			w := wb.New(b.Len())
+
+			// random single-bit ops, mostly below the length
+			for i := 0; i < 2000; i++ {
+
+				idx := uint(r.Intn(int(max/2) + 1))
+
+				if r.Intn(8) == 0 {
+					idx = uint(r.Intn(int(max) + 1))
+				}
+
+				switch r.Intn(4) {
+				case 0:
+					b.Set(idx)
+					w.Set(idx)
+
+				case 1:
+					b.Clear(idx)
+					w.Clear(idx)
+
+				case 2:
+					b.Flip(idx)
+					w.Flip(idx)
+
+				case 3:
+					b.SetTo(idx, idx%2 == 0)
+					w.SetTo(idx, idx%2 == 0)
+				}
+
+				assert.Equal(t, w.Test(idx), b.Test(idx))
+			}
+
+			assertSameBitSet(t, w, b)
+
+			for i := uint(0); i < b.Len()+2; i += 7 {
+
+				wi, wok := w.NextSet(i)
+				bi, bok := b.NextSet(i)
+				assert.Equal(t, wok, bok)
+				assert.Equal(t, wi, bi)
+
+				wi, wok = w.NextClear(i)
+				bi, bok = b.NextClear(i)
+				assert.Equal(t, wok, bok)
+				assert.Equal(t, wi, bi)
+			}
+
+			assertSameBitSet(t, w.Complement(), b.Complement())
+
+			// a shorter operand, converted from willf
+			w2 := wb.New(max / 3)
+
+			for i := uint(0); i < w2.Len(); i += uint(r.Intn(5) + 1) {
+				w2.Set(i)
+			}
+
+			b2, err := FromWillf(w2, cfg)
+			assert.NoError(t, err)
+			assertSameBitSet(t, w2, b2)
+
+			assertSameBitSet(t, w.Union(w2), b.Union(b2))
+			assertSameBitSet(t, w.Intersection(w2), b.Intersection(b2))
+			assertSameBitSet(t, w.Difference(w2), b.Difference(b2))
+			assertSameBitSet(t, w.SymmetricDifference(w2), b.SymmetricDifference(b2))
+			assertSameBitSet(t, w2.Intersection(w), b2.Intersection(b))
+
+			assert.Equal(t, w.UnionCardinality(w2), b.UnionCardinality(b2))
+			assert.Equal(t, w.IntersectionCardinality(w2), b.IntersectionCardinality(b2))
+			assert.Equal(t, w.DifferenceCardinality(w2), b.DifferenceCardinality(b2))
+			assert.Equal(t, w.SymmetricDifferenceCardinality(w2), b.SymmetricDifferenceCardinality(b2))
+
+			u, wu := b.Union(b2), w.Union(w2)
+			assert.Equal(t, wu.IsSuperSet(w2), u.IsSuperSet(b2))
+			assert.Equal(t, wu.IsStrictSuperSet(w2), u.IsStrictSuperSet(b2))
+			assert.Equal(t, w2.IsSuperSet(wu), b2.IsSuperSet(u))
+			assert.Equal(t, wu.Equal(wu.Clone()), u.Equal(u.Clone()))
+			assert.Equal(t, w.Equal(w2), b.Equal(b2))
+
+			// in-place ops, with the shorter operand on either side
+			for _, op := range []struct {
+				name string
+				w    func(a, b *wb.BitSet)
+				b    func(a, b *BitSet)
+			}{
+				{"union", (*wb.BitSet).InPlaceUnion, (*BitSet).InPlaceUnion},
+				{"intersection", (*wb.BitSet).InPlaceIntersection, (*BitSet).InPlaceIntersection},
+				{"difference", (*wb.BitSet).InPlaceDifference, (*BitSet).InPlaceDifference},
+				{"symmetric", (*wb.BitSet).InPlaceSymmetricDifference, (*BitSet).InPlaceSymmetricDifference},
+			} {
+				wc, bc := w.Clone(), b.Clone()
+				op.w(wc, w2)
+				op.b(bc, b2)
+				assertSameBitSet(t, wc, bc)
+
+				wc, bc = w2.Clone(), b2.Clone()
+				op.w(wc, w)
+				op.b(bc, b)
+				assertSameBitSet(t, wc, bc)
+			}
+
+			// copy into the longer one
+			wc, bc := w.Clone(), b.Clone()
+			assert.Equal(t, w2.Copy(wc), b2.Copy(bc))
+			assertSameBitSet(t, wc, bc)
+
+			// the encodings are willf's
+			data, err := b.MarshalBinary()
+			assert.NoError(t, err)
+
+			wdata, _ := w.MarshalBinary()
+			assert.Equal(t, wdata, data)
+
+			bc, _ = NewBitSet(0, cfg)
+			assert.NoError(t, bc.UnmarshalBinary(data))
+			assertSameBitSet(t, w, bc)
+
+			data, err = b.MarshalJSON()
+			assert.NoError(t, err)
+
+			bc, _ = NewBitSet(0, cfg)
+			assert.NoError(t, bc.UnmarshalJSON(data))
+			assertSameBitSet(t, w, bc)
+
+			b.ClearAll()
+			w.ClearAll()
+			assertSameBitSet(t, w, b)
+			assert.Equal(t, w.None(), b.None())
+		})
+	}
+}
+
+func TestBitSetWillfLayouts(t *testing.T) {
+
+	a, _ := NewBitSet(0, []uint{8, 4})
+	b, _ := NewBitSet(0, []uint{4, 4, 4})
+
+	a.Set(1).Set(100).Set(1000)
+	b.Set(100).Set(4000)
+
+	// operands with different layouts are converted
+	assert.Equal(t, "{1,100,1000,4000}", a.Union(b).String())
+	assert.Equal(t, "{100}", b.Intersection(a).String())
+	assert.False(t, a.Equal(b))
+
+	// beyond the capacity of the layout
+	_, err := NewBitSet(1<<12+1, []uint{8, 4})
+	assert.Equal(t, ErrOutOfRange, err)
+	assert.Panics(t, func() { a.Set(1 << 12) })
+
+	_, err = FromWillf(wb.New(1<<13), []uint{8, 4})
+	assert.Equal(t, ErrOutOfRange, err)
+}